@@ -0,0 +1,154 @@
+package operations
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default number of access log lines waiting to be written
+const defaultAccessLogBuffer = 1024
+
+// AccessLogEntry is a single line of the access log
+type AccessLogEntry struct {
+	Time             string  `json:"time"`
+	ClientIP         string  `json:"client_ip"`
+	URI              string  `json:"uri"`
+	RewrittenURI     string  `json:"rewritten_uri,omitempty"`
+	Operation        string  `json:"operation"`
+	Layer            string  `json:"layer,omitempty"`
+	TileMatrixSet    string  `json:"tilematrixset,omitempty"`
+	TileMatrix       string  `json:"tilematrix,omitempty"`
+	TileCol          string  `json:"tilecol,omitempty"`
+	TileRow          string  `json:"tilerow,omitempty"`
+	Status           int     `json:"status"`
+	Bytes            int64   `json:"bytes"`
+	Duration         float64 `json:"duration_ms"`
+	UpstreamDuration float64 `json:"upstream_duration_ms,omitempty"`
+}
+
+// AccessLogger writes the access log as JSON lines. The lines are written asynchronously,
+// when the writer can't keep up the lines are dropped and counted instead of blocking
+// the requests.
+type AccessLogger struct {
+	config  func() *Config
+	entries chan AccessLogEntry
+	dropped atomic.Int64
+	done    chan struct{}
+
+	// mu guards closed, so a line logged while closing is not sent on the closed channel
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewAccessLogger starts an access logger writing to w, buffer is the number of lines that
+// can wait to be written. Config is called on every request for the trusted proxies, so the
+// client IP is the same as the one the rate limiter uses. Close stops the logger after writing
+// the waiting lines.
+func NewAccessLogger(config func() *Config, w io.Writer, buffer int) *AccessLogger {
+	if buffer <= 0 {
+		buffer = defaultAccessLogBuffer
+	}
+	l := &AccessLogger{config: config, entries: make(chan AccessLogEntry, buffer), done: make(chan struct{})}
+	go l.write(w)
+	return l
+}
+
+// Log queues the entry, it never blocks. An entry logged after Close is dropped.
+func (l *AccessLogger) Log(entry AccessLogEntry) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of lines dropped because the writer couldn't keep up
+func (l *AccessLogger) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// Close writes the waiting lines and stops the logger, lines logged after Close are dropped
+func (l *AccessLogger) Close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.entries)
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+// write encodes the entries, the output is flushed whenever no more entries are waiting
+func (l *AccessLogger) write(w io.Writer) {
+	defer close(l.done)
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	for entry := range l.entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("could not write access log: %v", err)
+		}
+		if len(l.entries) == 0 {
+			bw.Flush()
+		}
+	}
+	bw.Flush()
+}
+
+// Handler logs every request handled by next, the request passed on to next has a RequestInfo
+func (l *AccessLogger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := GetRequestInfo(r)
+		if info == nil {
+			r, info = WithRequestInfo(r)
+		}
+
+		start := time.Now()
+		uri := r.URL.RequestURI()
+		srw := &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(srw, r)
+		if len(info.CredentialParameter) > 0 {
+			// the API key is not logged
+			if path, query, ok := strings.Cut(uri, "?"); ok {
+				query, _, _ = removeQueryParameter(query, info.CredentialParameter)
+				uri = strings.TrimSuffix(path+"?"+query, "?")
+			}
+		}
+
+		entry := AccessLogEntry{
+			Time:             start.UTC().Format(time.RFC3339Nano),
+			ClientIP:         forwardedIP(r, l.config().TrustedProxies),
+			URI:              uri,
+			Operation:        valueOrDefault(info.Operation, operationPassthrough),
+			Layer:            info.Layer,
+			TileMatrixSet:    info.TileMatrixSet,
+			TileMatrix:       info.TileMatrix,
+			TileCol:          info.TileCol,
+			TileRow:          info.TileRow,
+			Status:           srw.statusCode,
+			Bytes:            srw.bytes,
+			Duration:         milliseconds(time.Since(start)),
+			UpstreamDuration: milliseconds(info.UpstreamDuration),
+		}
+		if rewritten := r.URL.RequestURI(); rewritten != uri {
+			entry.RewrittenURI = rewritten
+		}
+		l.Log(entry)
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
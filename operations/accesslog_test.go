@@ -0,0 +1,113 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLoggerHandler(t *testing.T) {
+	config := &Config{Host: "http://default"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	var out bytes.Buffer
+	logger := NewAccessLogger(testConfig(t, &Config{Host: "http://default", TrustedProxies: 2}), &out, 10)
+	handler := logger.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ProcessRequest(config, w, r) {
+			GetRequestInfo(r).UpstreamDuration = 5 * time.Millisecond
+			w.Write([]byte("tile"))
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/wmts?service=WMTS&request=GetTile&version=1.0.0&layer=osm&tilematrixset=EPSG:3857&tilematrix=01&tilecol=2&tilerow=3&format=image/png", nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	logger.Close()
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON line, got: %s %s", out.String(), err)
+	}
+	if entry.ClientIP != "198.51.100.7" || entry.Operation != "GetTile" || entry.Layer != "osm" || entry.TileMatrixSet != "EPSG:3857" ||
+		entry.TileMatrix != "01" || entry.TileCol != "2" || entry.TileRow != "3" || entry.Status != 200 || entry.Bytes != 4 || entry.UpstreamDuration != 5 {
+		t.Errorf("Expected the request in the access log, got: %+v", entry)
+	}
+	if entry.RewrittenURI != "/wmts/osm/EPSG:3857/01/2/3.png" || !strings.HasPrefix(entry.URI, "/wmts?service=WMTS") {
+		t.Errorf("Expected the original and rewritten URI, got: %s %s", entry.URI, entry.RewrittenURI)
+	}
+}
+
+func TestAccessLoggerPassthrough(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewAccessLogger(testConfig(t, &Config{Host: "http://default"}), &out, 10)
+	handler := logger.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	r := httptest.NewRequest("GET", "/favicon.ico", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	// without trusted proxies the header is ignored, any client can set it
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	logger.Close()
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON line, got: %s %s", out.String(), err)
+	}
+	if entry.ClientIP != "192.0.2.1" || entry.Operation != "passthrough" || entry.Status != 404 || len(entry.RewrittenURI) > 0 {
+		t.Errorf("Expected the passthrough request in the access log, got: %+v", entry)
+	}
+}
+
+// blockingWriter blocks every write until release is closed
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return len(b), nil
+}
+
+func TestAccessLoggerDrops(t *testing.T) {
+	w := blockingWriter{release: make(chan struct{})}
+	logger := NewAccessLogger(testConfig(t, &Config{Host: "http://default"}), w, 1)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			logger.Log(AccessLogEntry{URI: "/"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected logging not to block")
+	}
+	if logger.Dropped() < 8 {
+		t.Errorf("Expected at least 8 dropped lines, got: %d", logger.Dropped())
+	}
+	close(w.release)
+	logger.Close()
+}
+
+func TestAccessLoggerLogAfterClose(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewAccessLogger(testConfig(t, &Config{Host: "http://default"}), &out, 10)
+	logger.Close()
+	logger.Close()
+
+	logger.Log(AccessLogEntry{URI: "/"})
+	if logger.Dropped() != 1 || out.Len() > 0 {
+		t.Errorf("Expected a line logged after Close to be dropped, got: %d %s", logger.Dropped(), out.String())
+	}
+}
@@ -0,0 +1,225 @@
+package operations
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of the query parameter and header holding the API key
+const (
+	defaultAuthParameter = "apikey"
+	defaultAuthHeader    = "X-API-Key"
+)
+
+var (
+	errNoCredentials  = errors.New("no credentials")
+	errInvalidKey     = errors.New("invalid API key or token")
+	errExpiredToken   = errors.New("the token has expired")
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmts_auth_failures_total",
+		Help: "Number of requests refused by the authentication by reason.",
+	}, []string{"reason"})
+)
+
+// tokenClaims is the payload of a signed token
+type tokenClaims struct {
+	Subject string `json:"sub,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// SignToken returns a token for the subject that is valid until expires, it has the form
+// <payload>.<signature> with the base64url encoded JSON payload {"sub":...,"exp":...}
+// and its base64url encoded HMAC-SHA256 signature
+func SignToken(secret, subject string, expires time.Time) string {
+	payload, _ := json.Marshal(tokenClaims{Subject: subject, Expires: expires.Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(secret, encoded))
+}
+
+func tokenSignature(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verifyToken checks the signature and the expiry of the token and returns its subject
+func verifyToken(secret, token string, now time.Time) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errInvalidKey
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sum, tokenSignature(secret, payload)) {
+		return "", errInvalidKey
+	}
+	content, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errInvalidKey
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(content, &claims); err != nil || claims.Expires <= 0 {
+		return "", errInvalidKey
+	}
+	if !now.Before(time.Unix(claims.Expires, 0)) {
+		return "", errExpiredToken
+	}
+	return claims.Subject, nil
+}
+
+// loadAuthKeys reads the API keys from the file, one key per line optionally followed by the
+// name of the client. Empty lines and lines starting with # are skipped. Only the SHA-256 sums
+// of the keys are kept, with the client names.
+func loadAuthKeys(path string) (map[[sha256.Size]byte]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the key file: %w", err)
+	}
+	defer f.Close()
+
+	keys := map[[sha256.Size]byte]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var client string
+		if len(fields) > 1 {
+			client = fields[1]
+		}
+		keys[sha256.Sum256([]byte(fields[0]))] = client
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the key file: %w", err)
+	}
+	return keys, nil
+}
+
+// authEnabled tells if the requests need an API key or token
+func (c *Config) authEnabled() bool {
+	return len(c.AuthKeyFile) > 0 || len(c.AuthTokenSecret) > 0
+}
+
+// authenticate checks the credential against the keys of the key file and, when it is not
+// one of them, as a token signed with the secret. It returns the name of the client.
+func (c *Config) authenticate(credential string, now time.Time) (string, error) {
+	if len(credential) == 0 {
+		return "", errNoCredentials
+	}
+	if client, ok := c.authKeys[sha256.Sum256([]byte(credential))]; ok {
+		return client, nil
+	}
+	if len(c.AuthTokenSecret) > 0 {
+		return verifyToken(c.AuthTokenSecret, credential, now)
+	}
+	return "", errInvalidKey
+}
+
+// Authenticator refuses the requests without a valid API key or token with a 401 exception.
+// The credential is read from the query parameter AuthParameter, the header AuthHeader or
+// a Bearer token in the Authorization header, and removed before the request is forwarded.
+type Authenticator struct {
+	config func() *Config
+}
+
+// NewAuthenticator returns the authenticator for the config in use, config is called on every request
+func NewAuthenticator(config func() *Config) *Authenticator {
+	return &Authenticator{config: config}
+}
+
+// Handler passes the authenticated requests on to next, without auth configured all requests are passed on
+func (a *Authenticator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := a.config()
+		if !config.authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		credential := config.takeCredential(r)
+		client, err := config.authenticate(credential, time.Now())
+		if err != nil {
+			reason := "invalid"
+			switch {
+			case errors.Is(err, errNoCredentials):
+				reason = "missing"
+			case errors.Is(err, errExpiredToken):
+				reason = "expired"
+			}
+			authFailuresTotal.WithLabelValues(reason).Inc()
+			if operation := config.requestOperation(r); len(operation) > 0 {
+				setOperation(r, operation)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wmts"`)
+			message := "An API key or token is required"
+			if reason != "missing" {
+				message = "The API key or token is invalid or has expired"
+			}
+			SendError(WMTSException{ErrorMessage: message, ErrorCode: "NoApplicableCode", StatusCode: http.StatusUnauthorized}, w, r)
+			return
+		}
+		if info := GetRequestInfo(r); info != nil {
+			info.Client = client
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeCredential returns the credential of the request and removes it from the query and the headers
+func (c *Config) takeCredential(r *http.Request) string {
+	var credential string
+	parameter := valueOrDefault(c.AuthParameter, defaultAuthParameter)
+	if query, value, ok := removeQueryParameter(r.URL.RawQuery, parameter); ok {
+		r.URL.RawQuery = query
+		credential = value
+		if info := GetRequestInfo(r); info != nil {
+			info.CredentialParameter = parameter
+		}
+	}
+
+	header := valueOrDefault(c.AuthHeader, defaultAuthHeader)
+	credential = valueOrDefault(credential, r.Header.Get(header))
+	r.Header.Del(header)
+
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		credential = valueOrDefault(credential, strings.TrimSpace(token))
+		r.Header.Del("Authorization")
+	}
+	return credential
+}
+
+// removeQueryParameter removes the parameter, matched case insensitive, from the raw query and
+// returns the first value. The order of the other parameters is kept.
+func removeQueryParameter(rawQuery, name string) (string, string, bool) {
+	var kept []string
+	var value string
+	found := false
+	for _, part := range strings.Split(rawQuery, "&") {
+		key, v, _ := strings.Cut(part, "=")
+		if k, err := url.QueryUnescape(key); err == nil && strings.EqualFold(k, name) {
+			if !found {
+				value, _ = url.QueryUnescape(v)
+			}
+			found = true
+			continue
+		}
+		kept = append(kept, part)
+	}
+	if !found {
+		return rawQuery, "", false
+	}
+	return strings.Join(kept, "&"), value, true
+}
@@ -0,0 +1,138 @@
+package operations
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeyFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticator(t *testing.T) {
+	var forwarded *http.Request
+	handler := NewAuthenticator(testConfig(t, &Config{AuthKeyFile: writeKeyFile(t, "# partners\nsecret-key\n\nother-key\n"), AuthTokenSecret: "hmac",
+		AuthParameter: defaultAuthParameter, AuthHeader: defaultAuthHeader})).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { forwarded = r }))
+	token := SignToken("hmac", "partner", time.Now().Add(time.Hour))
+
+	expected := []struct {
+		path   string
+		header string
+		value  string
+		status int
+	}{
+		{"/wmts?request=GetTile&apikey=secret-key", "", "", 200},
+		{"/wmts?request=GetTile&APIKEY=other-key", "", "", 200},
+		{"/wmts?request=GetTile", "X-API-Key", "secret-key", 200},
+		{"/wmts?request=GetTile", "Authorization", "Bearer " + token, 200},
+		{"/wmts?request=GetTile&apikey=" + token, "", "", 200},
+		{"/wmts?request=GetTile", "", "", 401},
+		{"/wmts?request=GetTile&apikey=wrong", "", "", 401},
+		{"/wmts?request=GetTile", "Authorization", "Bearer " + SignToken("other", "partner", time.Now().Add(time.Hour)), 401},
+		{"/wmts?request=GetTile", "Authorization", "Bearer " + SignToken("hmac", "partner", time.Now().Add(-time.Minute)), 401},
+		{"/wmts?request=GetTile", "Authorization", "Basic c2VjcmV0LWtleQ==", 401},
+	}
+	for _, e := range expected {
+		forwarded = nil
+		r := httptest.NewRequest("GET", e.path, nil)
+		if len(e.header) > 0 {
+			r.Header.Set(e.header, e.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != e.status {
+			t.Errorf("Expected %d for %s with %s %q, got: %d", e.status, e.path, e.header, e.value, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && (w.Header().Get("WWW-Authenticate") == "" || !strings.Contains(w.Body.String(), "ows:ExceptionReport")) {
+			t.Errorf("Expected a 401 exception report with WWW-Authenticate for %s, got: %v %s", e.path, w.Header(), w.Body.String())
+		}
+		if forwarded != nil && (forwarded.URL.RawQuery != "request=GetTile" || forwarded.Header.Get("X-API-Key") != "" || forwarded.Header.Get("Authorization") != "") {
+			t.Errorf("Expected the credential to be removed for %s, got: %s %v", e.path, forwarded.URL.RawQuery, forwarded.Header)
+		}
+	}
+}
+
+func TestAuthenticatorDisabled(t *testing.T) {
+	handler := NewAuthenticator(testConfig(t, &Config{})).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "request=GetTile&apikey=a" {
+			t.Errorf("Expected the query to be untouched, got: %s", r.URL.RawQuery)
+		}
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/wmts?request=GetTile&apikey=a", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected requests to pass without auth, got: %d", w.Code)
+	}
+}
+
+func TestAuthenticatorForwardedQuery(t *testing.T) {
+	config := &Config{Host: "http://localhost", AuthTokenSecret: "hmac", AuthParameter: "token"}
+	handler := NewAuthenticator(testConfig(t, config)).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ProcessRequest(config, w, r) {
+			t.Errorf("Expected the GetTile request to be proxied")
+		}
+		if strings.Contains(strings.ToLower(r.URL.String()), "token") {
+			t.Errorf("Expected the token not to be forwarded, got: %s", r.URL)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/wmts?SERVICE=WMTS&VERSION=1.0.0&REQUEST=GetTile&LAYER=brt&STYLE=default&TILEMATRIXSET=EPSG:28992&TILEMATRIX=04&TILEROW=8&TILECOL=7&FORMAT=image/png&Token="+SignToken("hmac", "", time.Now().Add(time.Hour)), nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestAuthenticatorAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	config := testConfig(t, &Config{AuthTokenSecret: "hmac", AuthParameter: defaultAuthParameter})
+	logger := NewAccessLogger(config, &out, 0)
+	handler := logger.Handler(NewAuthenticator(config).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/wmts?apikey=secret&request=GetTile", nil))
+	logger.Close()
+	if strings.Contains(out.String(), "secret") || !strings.Contains(out.String(), `"uri":"/wmts?request=GetTile"`) {
+		t.Errorf("Expected the API key to be left out of the access log, got: %s", out.String())
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	now := time.Now()
+	token := SignToken("hmac", "partner", now.Add(time.Minute))
+	if subject, err := verifyToken("hmac", token, now); err != nil || subject != "partner" {
+		t.Errorf("Expected a valid token for partner, got: %q %v", subject, err)
+	}
+	if _, err := verifyToken("hmac", token, now.Add(time.Minute)); err != errExpiredToken {
+		t.Errorf("Expected an expired token, got: %v", err)
+	}
+	payload, _, _ := strings.Cut(token, ".")
+	for _, invalid := range []string{"", "token", payload, payload + ".", payload + "." + strings.Repeat("A", 43)} {
+		if _, err := verifyToken("hmac", invalid, now); err != errInvalidKey {
+			t.Errorf("Expected %q to be invalid, got: %v", invalid, err)
+		}
+	}
+}
+
+func TestRemoveQueryParameter(t *testing.T) {
+	query, value, ok := removeQueryParameter("b=1&ApiKey=a%2Bb&a=2&apikey=c", "apikey")
+	if !ok || query != "b=1&a=2" || value != "a+b" {
+		t.Errorf("Expected b=1&a=2 and a+b, got: %s %s %t", query, value, ok)
+	}
+	if query, _, ok := removeQueryParameter("b=1", "apikey"); ok || query != "b=1" {
+		t.Errorf("Expected the query to be unchanged, got: %s %t", query, ok)
+	}
+}
+
+func TestRedactedAuthTokenSecret(t *testing.T) {
+	config := &Config{AuthTokenSecret: "hmac"}
+	if s := config.String(); strings.Contains(s, "hmac") || !strings.Contains(s, "authTokenSecret: "+redacted) {
+		t.Errorf("Expected the token secret to be redacted, got: %s", s)
+	}
+}
@@ -0,0 +1,259 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Host used when rendering the capabilities template to read the ResourceURLs,
+// it is stripped from the templates so only the path remains
+const resourceURLHost = "resourceurl.invalid"
+
+// Resource types of the ResourceURL elements
+const (
+	resourceTypeTile        = "tile"
+	resourceTypeFeatureInfo = "featureinfo"
+)
+
+// capabilities contains the parts of a WMTS Capabilities document
+// needed for rewriting and validating requests
+type capabilities struct {
+	UpdateSequence string                      `xml:"updateSequence,attr"`
+	Layers         []capabilitiesLayer         `xml:"Contents>Layer"`
+	TileMatrixSets []capabilitiesTileMatrixSet `xml:"Contents>TileMatrixSet"`
+
+	layers         map[string]*capabilitiesLayer
+	tileMatrixSets map[string]*capabilitiesTileMatrixSet
+}
+
+type capabilitiesLayer struct {
+	Identifier         string                  `xml:"Identifier"`
+	Styles             []capabilitiesStyle     `xml:"Style"`
+	Formats            []string                `xml:"Format"`
+	InfoFormats        []string                `xml:"InfoFormat"`
+	TileMatrixSetLinks []tileMatrixSetLink     `xml:"TileMatrixSetLink"`
+	Dimensions         []capabilitiesDimension `xml:"Dimension"`
+	ResourceURLs       []resourceURL           `xml:"ResourceURL"`
+}
+
+type capabilitiesStyle struct {
+	Identifier string `xml:"Identifier"`
+	IsDefault  bool   `xml:"isDefault,attr"`
+}
+
+type tileMatrixSetLink struct {
+	TileMatrixSet string             `xml:"TileMatrixSet"`
+	Limits        []tileMatrixLimits `xml:"TileMatrixSetLimits>TileMatrixLimits"`
+}
+
+type tileMatrixLimits struct {
+	TileMatrix string `xml:"TileMatrix"`
+	MinTileRow int    `xml:"MinTileRow"`
+	MaxTileRow int    `xml:"MaxTileRow"`
+	MinTileCol int    `xml:"MinTileCol"`
+	MaxTileCol int    `xml:"MaxTileCol"`
+}
+
+type capabilitiesDimension struct {
+	Identifier string   `xml:"Identifier"`
+	Default    string   `xml:"Default"`
+	Values     []string `xml:"Value"`
+}
+
+type capabilitiesTileMatrixSet struct {
+	Identifier   string                   `xml:"Identifier"`
+	TileMatrices []capabilitiesTileMatrix `xml:"TileMatrix"`
+}
+
+type capabilitiesTileMatrix struct {
+	Identifier   string `xml:"Identifier"`
+	TileWidth    int    `xml:"TileWidth"`
+	TileHeight   int    `xml:"TileHeight"`
+	MatrixWidth  int    `xml:"MatrixWidth"`
+	MatrixHeight int    `xml:"MatrixHeight"`
+}
+
+type resourceURL struct {
+	Format       string `xml:"format,attr"`
+	ResourceType string `xml:"resourceType,attr"`
+	Template     string `xml:"template,attr"`
+}
+
+// resourceTemplate is the path template of a ResourceURL
+type resourceTemplate struct {
+	layer        string
+	resourceType string
+	format       string
+	template     *pathTemplate
+}
+
+// resourceTemplates holds the path templates from the ResourceURLs
+// by layer, resource type and format
+type resourceTemplates map[string]resourceTemplate
+
+func resourceTemplateKey(layer string, resourceType string, format string) string {
+	return layer + "\n" + strings.ToLower(resourceType) + "\n" + format
+}
+
+// get returns the template for the layer, resource type and format, if available
+func (rt resourceTemplates) get(layer string, resourceType string, format string) (*pathTemplate, bool) {
+	t, ok := rt[resourceTemplateKey(layer, resourceType, format)]
+	return t.template, ok
+}
+
+// sorted returns the templates ordered by layer, resource type and format
+func (rt resourceTemplates) sorted() []resourceTemplate {
+	keys := make([]string, 0, len(rt))
+	for k := range rt {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	templates := make([]resourceTemplate, 0, len(rt))
+	for _, k := range keys {
+		templates = append(templates, rt[k])
+	}
+	return templates
+}
+
+// loadCapabilities parses the capabilities template, renders it and parses the result
+func loadCapabilities(path string) (*template.Template, *capabilities, error) {
+	t, err := getCapabilitiesTemplate(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := parseCapabilities(t)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse capabilities template %s: %w", path, err)
+	}
+	return t, c, nil
+}
+
+// parseCapabilities renders the capabilities template and parses the result
+func parseCapabilities(t *template.Template) (*capabilities, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, HostAndPath{Protocol: "http", Host: resourceURLHost}); err != nil {
+		return nil, err
+	}
+
+	var c capabilities
+	if err := xml.Unmarshal(buf.Bytes(), &c); err != nil {
+		return nil, err
+	}
+
+	c.layers = map[string]*capabilitiesLayer{}
+	for i := range c.Layers {
+		c.layers[c.Layers[i].Identifier] = &c.Layers[i]
+	}
+	c.tileMatrixSets = map[string]*capabilitiesTileMatrixSet{}
+	for i := range c.TileMatrixSets {
+		c.tileMatrixSets[c.TileMatrixSets[i].Identifier] = &c.TileMatrixSets[i]
+	}
+	return &c, nil
+}
+
+// defaultStyle returns the style marked as default for the layer
+func (l *capabilitiesLayer) defaultStyle() (string, bool) {
+	for _, s := range l.Styles {
+		if s.IsDefault {
+			return s.Identifier, true
+		}
+	}
+	return "", false
+}
+
+// tileMatrixSetLink returns the link of the layer to the tile matrix set
+func (l *capabilitiesLayer) tileMatrixSetLink(tileMatrixSet string) (*tileMatrixSetLink, bool) {
+	for i := range l.TileMatrixSetLinks {
+		if l.TileMatrixSetLinks[i].TileMatrixSet == tileMatrixSet {
+			return &l.TileMatrixSetLinks[i], true
+		}
+	}
+	return nil, false
+}
+
+// limits returns the limits for the tile matrix, if any
+func (l *tileMatrixSetLink) limits(tileMatrix string) (*tileMatrixLimits, bool) {
+	for i := range l.Limits {
+		if l.Limits[i].TileMatrix == tileMatrix {
+			return &l.Limits[i], true
+		}
+	}
+	return nil, false
+}
+
+// tileMatrix returns the tile matrix of the set
+func (s *capabilitiesTileMatrixSet) tileMatrix(tileMatrix string) (*capabilitiesTileMatrix, bool) {
+	for i := range s.TileMatrices {
+		if s.TileMatrices[i].Identifier == tileMatrix {
+			return &s.TileMatrices[i], true
+		}
+	}
+	return nil, false
+}
+
+// layerDimensions returns the dimensions declared for every layer
+func (c *capabilities) layerDimensions() map[string][]Dimension {
+	dimensions := map[string][]Dimension{}
+	for _, layer := range c.Layers {
+		for _, d := range layer.Dimensions {
+			dimensions[layer.Identifier] = append(dimensions[layer.Identifier],
+				Dimension{Layer: layer.Identifier, Identifier: d.Identifier, Default: d.Default})
+		}
+	}
+	return dimensions
+}
+
+// resourceTemplates reads the ResourceURL elements of every layer into path templates,
+// placeholders for the dimensions of the layer are allowed
+func (c *capabilities) resourceTemplates(dimensions func(layer string) []Dimension) (resourceTemplates, error) {
+	templates := resourceTemplates{}
+	for _, layer := range c.Layers {
+		for _, resource := range layer.ResourceURLs {
+			var required []string
+			switch strings.ToLower(resource.ResourceType) {
+			case resourceTypeTile:
+				required = tileTemplatePlaceholders
+			case resourceTypeFeatureInfo:
+				required = featureInfoTemplatePlaceholders
+			default:
+				continue
+			}
+
+			path, absolute := resourceURLPath(resource.Template)
+			pt, err := parsePathTemplate(path, required, dimensionPlaceholders(dimensions(layer.Identifier)))
+			if err != nil {
+				return nil, fmt.Errorf("invalid ResourceURL for layer %s: %w", layer.Identifier, err)
+			}
+			pt.absolute = absolute
+			templates[resourceTemplateKey(layer.Identifier, resource.ResourceType, resource.Format)] = resourceTemplate{
+				layer: layer.Identifier, resourceType: strings.ToLower(resource.ResourceType), format: resource.Format, template: pt}
+		}
+	}
+	return templates, nil
+}
+
+// resourceURLPath strips the protocol and host from a ResourceURL template. The remaining
+// path is relative to the path of the incoming request, unless the ResourceURL has a fixed
+// host: then it is the absolute path on the upstream.
+func resourceURLPath(template string) (string, bool) {
+	scheme, rest, ok := strings.Cut(template, "://")
+	if !ok || strings.Contains(scheme, "/") {
+		return template, false
+	}
+	host, path := rest, ""
+	if j := strings.Index(rest, "/"); j >= 0 {
+		host, path = rest[:j], rest[j:]
+	}
+	// the path is cut from the template itself, the placeholders would be escaped by url.Parse
+	if u, err := url.Parse(scheme + "://" + host); err == nil && u.Hostname() == resourceURLHost {
+		return path, false
+	}
+	return path, true
+}
@@ -0,0 +1,112 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadResourceTemplates(t *testing.T) {
+	_, capabilities, err := loadCapabilities("testCapabilitiesTemplate")
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	templates, err := capabilities.resourceTemplates(func(layer string) []Dimension { return capabilities.layerDimensions()[layer] })
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	tile, ok := templates.get("osm", "tile", "image/png")
+	if !ok {
+		t.Fatalf("Expected a tile template for layer osm")
+	}
+	expected := "/osm/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png"
+	if tile.String() != expected {
+		t.Errorf("Expected %s but was not, got: %s", expected, tile)
+	}
+
+	if _, ok := templates.get("osm", "FeatureInfo", "application/json"); !ok {
+		t.Errorf("Expected a FeatureInfo template for layer osm")
+	}
+	if _, ok := templates.get("plain", "tile", "image/png"); ok {
+		t.Errorf("Expected no tile template for layer plain")
+	}
+}
+
+func TestResourceURLPath(t *testing.T) {
+	input := map[string]string{
+		"http://" + resourceURLHost + "/osm/{TileMatrix}/{TileCol}/{TileRow}.png":  "/osm/{TileMatrix}/{TileCol}/{TileRow}.png",
+		"https://" + resourceURLHost + "/osm/{TileMatrix}/{TileCol}/{TileRow}.png": "/osm/{TileMatrix}/{TileCol}/{TileRow}.png",
+		"https://example.com/wmts/osm/{TileMatrix}/{TileCol}/{TileRow}.png":        "/wmts/osm/{TileMatrix}/{TileCol}/{TileRow}.png",
+		"https://example.com":                       "",
+		"/osm/{TileMatrix}/{TileCol}/{TileRow}.png": "/osm/{TileMatrix}/{TileCol}/{TileRow}.png",
+	}
+
+	for template, expected := range input {
+		result, absolute := resourceURLPath(template)
+		if result != expected || absolute != strings.HasPrefix(template, "https://example.com") {
+			t.Errorf("Expected %s but was not, got: %s %t", expected, result, absolute)
+		}
+	}
+}
+
+func TestProcessGetTileRequestFixedHostResourceURL(t *testing.T) {
+	content, _ := os.ReadFile("testCapabilitiesTemplate")
+	path := filepath.Join(t.TempDir(), "capabilities.xml")
+	template := strings.Replace(string(content), `template="{{ .Protocol }}://{{ .Host }}{{ .Path }}/osm/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png"`,
+		`template="https://tiles.example.com/tiles/service/wmts/osm/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png"`, 1)
+	if err := os.WriteFile(path, []byte(template), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Template: path}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/tiles/service/wmts",
+		RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png"}, Header: http.Header{}}
+	if err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if expected := "/tiles/service/wmts/osm/GLOBAL_MERCATOR/01/0/1.png"; mockRequest.URL.String() != expected {
+		t.Errorf("Expected %s but was not, got: %s", expected, mockRequest.URL.String())
+	}
+}
+
+func TestProcessRequestResourceURL(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"service=WMTS&request=GetTile&version=1.0.0&layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png":                             "local/osm/GLOBAL_MERCATOR/01/0/1.png",
+		"service=WMTS&request=GetTile&version=1.0.0&layer=plain&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png":                           "local/plain/GLOBAL_MERCATOR/01/1/0.png",
+		"service=WMTS&request=GetFeatureInfo&version=1.0.0&layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&infoformat=application/json&i=10&j=20": "local/osm/GLOBAL_MERCATOR/01/0/1/20/10.geojson",
+	}
+
+	for query, path := range expected {
+		var mockRequest = &http.Request{
+			Method:     "GET",
+			Host:       "example.com",
+			URL:        &url.URL{Path: "local", RawQuery: query},
+			Header:     http.Header{},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			RemoteAddr: "192.0.2.1:1234",
+		}
+		w := httptest.NewRecorder()
+
+		if ProcessRequest(config, w, mockRequest) != true {
+			t.Errorf("Expected request %s to be proxied, got: %s", query, w.Body.String())
+		}
+		if mockRequest.URL.String() != path {
+			t.Errorf("Expected %s but was not, got: %s", path, mockRequest.URL.String())
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package operations
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var certificateReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wmts_certificate_reloads_total",
+	Help: "Number of TLS certificate reloads by result.",
+}, []string{"result"})
+
+// CertificateReloader serves the TLS certificate from the certificate and key file, a reload
+// replaces it atomically. When the new pair fails to load it is logged and the last good
+// certificate stays in use.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	current  atomic.Pointer[tls.Certificate]
+	mu       sync.Mutex
+}
+
+// NewCertificateReloader loads the certificate and key file
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the TLS certificate: %w", err)
+	}
+	r.current.Store(&certificate)
+	return r, nil
+}
+
+// GetCertificate returns the certificate in use, it is meant for tls.Config.GetCertificate
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current.Load(), nil
+}
+
+// Reload loads the certificate and key file and, when successful, puts them in use
+func (r *CertificateReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		certificateReloadsTotal.WithLabelValues("failure").Inc()
+		log.Printf("TLS certificate reload failed, the last good certificate stays in use: %v", err)
+		return err
+	}
+	r.current.Store(&certificate)
+	certificateReloadsTotal.WithLabelValues("success").Inc()
+	log.Println("TLS certificate reloaded")
+	return nil
+}
+
+// Watch reloads the certificate whenever the certificate or key file changes, the files
+// are checked every interval until the context is done. Without an interval the files are not watched.
+func (r *CertificateReloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	files := []string{r.certFile, r.keyFile}
+	watchFiles(ctx, interval, func() []string { return files }, func() { r.Reload() })
+}
@@ -0,0 +1,108 @@
+package operations
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and key for the common name
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+}
+
+func commonName(t *testing.T, r *CertificateReloader) string {
+	certificate, _ := r.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	writeCertificate(t, certFile, keyFile, "second")
+	if err := reloader.Reload(); err != nil || commonName(t, reloader) != "second" {
+		t.Errorf("Expected the rotated certificate, got: %v %s", err, commonName(t, reloader))
+	}
+
+	if err := os.WriteFile(keyFile, []byte("broken"), 0o600); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if err := reloader.Reload(); err == nil || commonName(t, reloader) != "second" {
+		t.Errorf("Expected the last good certificate to stay in use, got: %v %s", err, commonName(t, reloader))
+	}
+}
+
+func TestCertificateWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond)
+
+	// give the watcher time to record the files and move the modification time forward
+	time.Sleep(50 * time.Millisecond)
+	writeCertificate(t, certFile, keyFile, "second")
+
+	deadline := time.Now().Add(time.Second)
+	for commonName(t, reloader) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the rotated certificate to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewCertificateReloaderMissing(t *testing.T) {
+	if _, err := NewCertificateReloader("missing.crt", "missing.key"); err == nil {
+		t.Errorf("Expected an error for missing files")
+	}
+}
@@ -0,0 +1,161 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Coalescer collapses identical GetTile requests that are in flight at the same time into a
+// single upstream request, the response is sent to every waiting client. The shared request
+// is not cancelled when one of the clients goes away, but it is when it takes longer than the
+// timeout, so a stalled upstream response doesn't hold up the later requests for the tile.
+type Coalescer struct {
+	next    http.Handler
+	timeout time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is an upstream request shared by the waiting clients
+type coalescedCall struct {
+	done     chan struct{}
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	aborted  bool
+	upstream time.Duration
+}
+
+// NewCoalescer returns a coalescer in front of next, the shared requests are cancelled after
+// the timeout, which should be the write timeout of the server. Without a timeout the default
+// write timeout is used.
+func NewCoalescer(next http.Handler, timeout time.Duration) *Coalescer {
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+	return &Coalescer{next: next, timeout: timeout, calls: map[string]*coalescedCall{}}
+}
+
+// Request headers that can make the response specific to the client, a request with one of them is not shared
+var unsharedHeaders = []string{"Range", "If-None-Match", "If-Modified-Since", "Authorization", "Cookie"}
+
+// ServeHTTP shares the upstream request with identical GetTile requests in flight,
+// all other requests are passed on to next
+func (c *Coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	info := GetRequestInfo(r)
+	if info == nil || info.Operation != OperationGetTile || r.Method != http.MethodGet || hasHeader(r, unsharedHeaders) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := upstreamRequestKey(r, info)
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &coalescedCall{done: make(chan struct{}), header: http.Header{}}
+		c.calls[key] = call
+		// the shared request gets its own RequestInfo, a client can be gone before it is done
+		ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, c.timeout)
+		shared, sharedInfo := WithRequestInfo(r.Clone(ctx))
+		*sharedInfo = *info
+		go c.fetch(key, call, shared, sharedInfo, cancel)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if call.aborted {
+		// same as the proxy does when the upstream response breaks off
+		panic(http.ErrAbortHandler)
+	}
+	info.UpstreamDuration = call.upstream
+	header := w.Header()
+	for k, v := range call.header {
+		header[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(call.status)
+	w.Write(call.body.Bytes())
+}
+
+// fetch does the shared upstream request and wakes up the waiting clients
+func (c *Coalescer) fetch(key string, call *coalescedCall, r *http.Request, info *RequestInfo, cancel context.CancelFunc) {
+	defer cancel()
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				log.Printf("panic in coalesced request for %s: %v\n%s", r.URL.RequestURI(), v, debug.Stack())
+			}
+			call.aborted = true
+		}
+		call.upstream = info.UpstreamDuration
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	c.next.ServeHTTP(call, r)
+	if call.status == 0 {
+		call.status = http.StatusOK
+	}
+}
+
+func (call *coalescedCall) Header() http.Header {
+	return call.header
+}
+
+func (call *coalescedCall) WriteHeader(code int) {
+	// informational responses are not passed on
+	if call.status == 0 && code >= 200 {
+		call.status = code
+	}
+}
+
+func (call *coalescedCall) Write(b []byte) (int, error) {
+	if call.status == 0 {
+		call.status = http.StatusOK
+	}
+	return call.body.Write(b)
+}
+
+// detachedContext keeps the values of the parent context, like the RequestInfo,
+// but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
+
+// hasHeader checks if the request has one of the headers
+func hasHeader(r *http.Request, headers []string) bool {
+	for _, header := range headers {
+		if len(r.Header.Get(header)) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package operations
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingUpstream answers a request only after release is closed
+type blockingUpstream struct {
+	started  chan struct{}
+	release  chan struct{}
+	requests atomic.Int32
+	err      atomic.Value
+}
+
+func newBlockingUpstream() *blockingUpstream {
+	return &blockingUpstream{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (u *blockingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.requests.Add(1)
+	u.started <- struct{}{}
+	<-u.release
+	if r.Context().Err() != nil {
+		u.err.Store(r.Context().Err())
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", `"tile"`)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("tile"))
+}
+
+func TestCoalescer(t *testing.T) {
+	upstream := newBlockingUpstream()
+	coalescer := NewCoalescer(upstream, time.Minute)
+
+	recorders := make([]*httptest.ResponseRecorder, 5)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			coalescer.ServeHTTP(w, tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+		}(recorders[i])
+	}
+	<-upstream.started
+	// give the other requests time to join the request in flight
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+
+	if upstream.requests.Load() != 1 {
+		t.Errorf("Expected 1 request to the upstream, got: %d", upstream.requests.Load())
+	}
+	for i, w := range recorders {
+		if w.Code != http.StatusCreated || w.Body.String() != "tile" || w.Header().Get("ETag") != `"tile"` {
+			t.Errorf("Expected the upstream response for client %d, got: %d %s %v", i, w.Code, w.Body.String(), w.Header())
+		}
+	}
+}
+
+func TestCoalescerDifferentRequests(t *testing.T) {
+	upstream := newBlockingUpstream()
+	close(upstream.release)
+	coalescer := NewCoalescer(upstream, time.Minute)
+
+	coalescer.ServeHTTP(httptest.NewRecorder(), tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+	coalescer.ServeHTTP(httptest.NewRecorder(), tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/1.png"))
+	coalescer.ServeHTTP(httptest.NewRecorder(), tileRequest("GetFeatureInfo", "/wmts/osm/EPSG:3857/01/0/1/1/1.html"))
+	if upstream.requests.Load() != 3 {
+		t.Errorf("Expected 3 requests to the upstream, got: %d", upstream.requests.Load())
+	}
+}
+
+func TestCoalescerCancelledClient(t *testing.T) {
+	upstream := newBlockingUpstream()
+	coalescer := NewCoalescer(upstream, time.Minute)
+
+	cancelled := tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png")
+	ctx, cancel := context.WithCancel(cancelled.Context())
+	cancelled = cancelled.WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		coalescer.ServeHTTP(httptest.NewRecorder(), cancelled)
+		close(done)
+	}()
+	<-upstream.started
+
+	w := httptest.NewRecorder()
+	waiting := make(chan struct{})
+	go func() {
+		coalescer.ServeHTTP(w, tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+		close(waiting)
+	}()
+
+	cancel()
+	<-done
+	close(upstream.release)
+	<-waiting
+
+	if upstream.err.Load() != nil {
+		t.Errorf("Expected the shared request not to be cancelled, got: %v", upstream.err.Load())
+	}
+	if w.Body.String() != "tile" {
+		t.Errorf("Expected the waiting client to get the tile, got: %s", w.Body.String())
+	}
+}
+
+func TestCoalescerTimeout(t *testing.T) {
+	upstream := newBlockingUpstream()
+	coalescer := NewCoalescer(upstream, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		coalescer.ServeHTTP(httptest.NewRecorder(), tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+		close(done)
+	}()
+	<-upstream.started
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.release)
+	<-done
+
+	if upstream.err.Load() != context.DeadlineExceeded {
+		t.Errorf("Expected the shared request to time out, got: %v", upstream.err.Load())
+	}
+}
+
+func TestCoalescerConditionalRequest(t *testing.T) {
+	var requests atomic.Int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		started <- struct{}{}
+		<-release
+		w.Header().Set("ETag", `"tile"`)
+		if r.Header.Get("If-None-Match") == `"tile"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("tile"))
+	})
+	coalescer := NewCoalescer(upstream, time.Minute)
+
+	conditional := tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png")
+	conditional.Header.Set("If-None-Match", `"tile"`)
+	wc, wp := httptest.NewRecorder(), httptest.NewRecorder()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		coalescer.ServeHTTP(wc, conditional)
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		coalescer.ServeHTTP(wp, tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		// the plain client joined the conditional request
+	}
+	close(release)
+	wg.Wait()
+
+	if requests.Load() != 2 || wc.Code != http.StatusNotModified {
+		t.Errorf("Expected the conditional request not to be shared, got: %d requests, %d", requests.Load(), wc.Code)
+	}
+	if wp.Code != http.StatusOK || wp.Body.String() != "tile" {
+		t.Errorf("Expected the tile for the plain client, got: %d %q", wp.Code, wp.Body.String())
+	}
+}
@@ -0,0 +1,488 @@
+package operations
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Placeholder for secrets in the printed config
+const redacted = "REDACTED"
+
+// Defaults of the HTTP server, the timeouts protect against slow clients holding on to connections
+const (
+	defaultListenAddress     = ":9001"
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// Config used for storing application startup parameters,
+// it can be read from a YAML file with LoadConfigFile
+type Config struct {
+	Host                 string            `yaml:"host"`
+	Upstreams            []Upstream        `yaml:"upstreams,omitempty"`
+	Mode                 string            `yaml:"mode"`
+	Template             string            `yaml:"template,omitempty"`
+	UpstreamCapabilities bool              `yaml:"upstreamCapabilities"`
+	CapabilitiesTTL      time.Duration     `yaml:"capabilitiesTTL"`
+	Logging              bool              `yaml:"logging"`
+	LogBuffer            int               `yaml:"logBuffer"`
+	ShutdownDelay        int               `yaml:"shutdownDelay"`
+	TileTemplate         string            `yaml:"tileTemplate,omitempty"`
+	FeatureInfoTemplate  string            `yaml:"featureInfoTemplate,omitempty"`
+	DefaultStyle         string            `yaml:"defaultStyle"`
+	Dimensions           []Dimension       `yaml:"dimensions,omitempty"`
+	FormatExtensions     map[string]string `yaml:"formats,omitempty"`
+	TileCacheSize        ByteSize          `yaml:"tileCacheSize"`
+	TileCacheTTL         time.Duration     `yaml:"tileCacheTTL"`
+	Coalesce             bool              `yaml:"coalesce"`
+	ReloadInterval       time.Duration     `yaml:"reloadInterval"`
+	ListenAddress        string            `yaml:"listenAddress"`
+	TLSCert              string            `yaml:"tlsCert,omitempty"`
+	TLSKey               string            `yaml:"tlsKey,omitempty"`
+	HTTP2                bool              `yaml:"http2"`
+	ReadHeaderTimeout    time.Duration     `yaml:"readHeaderTimeout"`
+	ReadTimeout          time.Duration     `yaml:"readTimeout"`
+	WriteTimeout         time.Duration     `yaml:"writeTimeout"`
+	IdleTimeout          time.Duration     `yaml:"idleTimeout"`
+	ConnectTimeout       time.Duration     `yaml:"upstreamConnectTimeout"`
+	ResponseTimeout      time.Duration     `yaml:"upstreamResponseTimeout"`
+	Retries              int               `yaml:"upstreamRetries"`
+	BreakerFailures      int               `yaml:"circuitBreakerFailures"`
+	BreakerCooldown      time.Duration     `yaml:"circuitBreakerCooldown"`
+	RateLimits           []RateLimit       `yaml:"rateLimits,omitempty"`
+	TrustedProxies       int               `yaml:"trustedProxies,omitempty"`
+	AuthKeyFile          string            `yaml:"authKeyFile,omitempty"`
+	AuthTokenSecret      string            `yaml:"authTokenSecret,omitempty"`
+	AuthParameter        string            `yaml:"authParameter"`
+	AuthHeader           string            `yaml:"authHeader"`
+	LayerPolicies        []LayerPolicy     `yaml:"layerPolicies,omitempty"`
+	CORSAllowedOrigins   []string          `yaml:"corsAllowedOrigins"`
+	CORSAllowedMethods   []string          `yaml:"corsAllowedMethods"`
+	CORSAllowedHeaders   []string          `yaml:"corsAllowedHeaders,omitempty"`
+	CORSExposedHeaders   []string          `yaml:"corsExposedHeaders,omitempty"`
+	CORSMaxAge           time.Duration     `yaml:"corsMaxAge"`
+
+	tileTemplate         *pathTemplate
+	featureInfoTemplate  *pathTemplate
+	resourceTemplates    resourceTemplates
+	layerDimensions      map[string][]Dimension
+	origin               *url.URL
+	upstreamCapabilities *upstreamCapabilities
+	capabilitiesTemplate *template.Template
+	capabilities         *capabilities
+	authKeys             map[[sha256.Size]byte]string
+}
+
+// NewConfig returns a config with the defaults of the application
+func NewConfig() *Config {
+	return &Config{
+		Host:               "http://localhost",
+		Mode:               ModeKVP,
+		CapabilitiesTTL:    defaultCapabilitiesTTL,
+		LogBuffer:          defaultAccessLogBuffer,
+		DefaultStyle:       defaultStyle,
+		FormatExtensions:   map[string]string{},
+		TileCacheTTL:       time.Minute,
+		Coalesce:           true,
+		ReloadInterval:     defaultReloadInterval,
+		ListenAddress:      defaultListenAddress,
+		HTTP2:              true,
+		ReadHeaderTimeout:  defaultReadHeaderTimeout,
+		ReadTimeout:        defaultReadTimeout,
+		WriteTimeout:       defaultWriteTimeout,
+		IdleTimeout:        defaultIdleTimeout,
+		ConnectTimeout:     defaultConnectTimeout,
+		ResponseTimeout:    defaultResponseTimeout,
+		Retries:            defaultRetries,
+		BreakerFailures:    defaultBreakerFailures,
+		BreakerCooldown:    defaultBreakerCooldown,
+		AuthParameter:      defaultAuthParameter,
+		AuthHeader:         defaultAuthHeader,
+		CORSAllowedOrigins: append([]string(nil), defaultCORSAllowedOrigins...),
+		CORSAllowedMethods: append([]string(nil), defaultCORSAllowedMethods...),
+	}
+}
+
+// LoadConfigFile reads the YAML config file into the config, settings missing
+// from the file keep their current value. Unknown settings are an error.
+func LoadConfigFile(path string, c *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// envOverrides are the environment variables that override the config, lists are comma separated
+var envOverrides = []struct {
+	name string
+	set  func(c *Config, value string) error
+}{
+	{"WMTS_HOST", func(c *Config, v string) error { c.Host = v; return nil }},
+	{"WMTS_UPSTREAMS", func(c *Config, v string) error {
+		c.Upstreams = nil
+		for _, value := range splitList(v) {
+			upstream, err := ParseUpstream(value)
+			if err != nil {
+				return err
+			}
+			c.Upstreams = append(c.Upstreams, upstream)
+		}
+		return nil
+	}},
+	{"WMTS_MODE", func(c *Config, v string) error { c.Mode = v; return nil }},
+	{"WMTS_RATE_LIMITS", func(c *Config, v string) error {
+		c.RateLimits = nil
+		for _, value := range splitList(v) {
+			limit, err := ParseRateLimit(value)
+			if err != nil {
+				return err
+			}
+			c.RateLimits = append(c.RateLimits, limit)
+		}
+		return nil
+	}},
+	{"WMTS_TRUSTED_PROXIES", func(c *Config, v string) (err error) { c.TrustedProxies, err = strconv.Atoi(v); return }},
+	{"WMTS_AUTH_KEY_FILE", func(c *Config, v string) error { c.AuthKeyFile = v; return nil }},
+	{"WMTS_AUTH_TOKEN_SECRET", func(c *Config, v string) error { c.AuthTokenSecret = v; return nil }},
+	{"WMTS_AUTH_PARAMETER", func(c *Config, v string) error { c.AuthParameter = v; return nil }},
+	{"WMTS_AUTH_HEADER", func(c *Config, v string) error { c.AuthHeader = v; return nil }},
+	{"WMTS_CORS_ALLOWED_ORIGINS", func(c *Config, v string) error { c.CORSAllowedOrigins = splitList(v); return nil }},
+	{"WMTS_CORS_ALLOWED_METHODS", func(c *Config, v string) error { c.CORSAllowedMethods = splitList(v); return nil }},
+	{"WMTS_CORS_ALLOWED_HEADERS", func(c *Config, v string) error { c.CORSAllowedHeaders = splitList(v); return nil }},
+	{"WMTS_CORS_EXPOSED_HEADERS", func(c *Config, v string) error { c.CORSExposedHeaders = splitList(v); return nil }},
+	{"WMTS_CORS_MAX_AGE", func(c *Config, v string) (err error) { c.CORSMaxAge, err = time.ParseDuration(v); return }},
+	{"WMTS_TEMPLATE", func(c *Config, v string) error { c.Template = v; return nil }},
+	{"WMTS_UPSTREAM_CAPABILITIES", func(c *Config, v string) (err error) { c.UpstreamCapabilities, err = strconv.ParseBool(v); return }},
+	{"WMTS_CAPABILITIES_TTL", func(c *Config, v string) (err error) { c.CapabilitiesTTL, err = time.ParseDuration(v); return }},
+	{"WMTS_LOGGING", func(c *Config, v string) (err error) { c.Logging, err = strconv.ParseBool(v); return }},
+	{"WMTS_LOG_BUFFER", func(c *Config, v string) (err error) { c.LogBuffer, err = strconv.Atoi(v); return }},
+	{"WMTS_SHUTDOWN_DELAY", func(c *Config, v string) (err error) { c.ShutdownDelay, err = strconv.Atoi(v); return }},
+	{"WMTS_TILE_TEMPLATE", func(c *Config, v string) error { c.TileTemplate = v; return nil }},
+	{"WMTS_FEATUREINFO_TEMPLATE", func(c *Config, v string) error { c.FeatureInfoTemplate = v; return nil }},
+	{"WMTS_DEFAULT_STYLE", func(c *Config, v string) error { c.DefaultStyle = v; return nil }},
+	{"WMTS_DIMENSIONS", func(c *Config, v string) error {
+		c.Dimensions = nil
+		for _, value := range splitList(v) {
+			dimension, err := ParseDimension(value)
+			if err != nil {
+				return err
+			}
+			c.Dimensions = append(c.Dimensions, dimension)
+		}
+		return nil
+	}},
+	{"WMTS_FORMATS", func(c *Config, v string) error {
+		c.FormatExtensions = map[string]string{}
+		for _, value := range splitList(v) {
+			format, extension, err := ParseFormatExtension(value)
+			if err != nil {
+				return err
+			}
+			c.FormatExtensions[format] = extension
+		}
+		return nil
+	}},
+	{"WMTS_TILE_CACHE_SIZE", func(c *Config, v string) error { return c.TileCacheSize.Set(v) }},
+	{"WMTS_TILE_CACHE_TTL", func(c *Config, v string) (err error) { c.TileCacheTTL, err = time.ParseDuration(v); return }},
+	{"WMTS_COALESCE", func(c *Config, v string) (err error) { c.Coalesce, err = strconv.ParseBool(v); return }},
+	{"WMTS_RELOAD_INTERVAL", func(c *Config, v string) (err error) { c.ReloadInterval, err = time.ParseDuration(v); return }},
+	{"WMTS_LISTEN_ADDRESS", func(c *Config, v string) error { c.ListenAddress = v; return nil }},
+	{"WMTS_TLS_CERT", func(c *Config, v string) error { c.TLSCert = v; return nil }},
+	{"WMTS_TLS_KEY", func(c *Config, v string) error { c.TLSKey = v; return nil }},
+	{"WMTS_HTTP2", func(c *Config, v string) (err error) { c.HTTP2, err = strconv.ParseBool(v); return }},
+	{"WMTS_READ_HEADER_TIMEOUT", func(c *Config, v string) (err error) { c.ReadHeaderTimeout, err = time.ParseDuration(v); return }},
+	{"WMTS_READ_TIMEOUT", func(c *Config, v string) (err error) { c.ReadTimeout, err = time.ParseDuration(v); return }},
+	{"WMTS_WRITE_TIMEOUT", func(c *Config, v string) (err error) { c.WriteTimeout, err = time.ParseDuration(v); return }},
+	{"WMTS_IDLE_TIMEOUT", func(c *Config, v string) (err error) { c.IdleTimeout, err = time.ParseDuration(v); return }},
+	{"WMTS_UPSTREAM_CONNECT_TIMEOUT", func(c *Config, v string) (err error) { c.ConnectTimeout, err = time.ParseDuration(v); return }},
+	{"WMTS_UPSTREAM_RESPONSE_TIMEOUT", func(c *Config, v string) (err error) { c.ResponseTimeout, err = time.ParseDuration(v); return }},
+	{"WMTS_UPSTREAM_RETRIES", func(c *Config, v string) (err error) { c.Retries, err = strconv.Atoi(v); return }},
+	{"WMTS_CIRCUIT_BREAKER_FAILURES", func(c *Config, v string) (err error) { c.BreakerFailures, err = strconv.Atoi(v); return }},
+	{"WMTS_CIRCUIT_BREAKER_COOLDOWN", func(c *Config, v string) (err error) { c.BreakerCooldown, err = time.ParseDuration(v); return }},
+}
+
+// ApplyEnv overrides the config with the WMTS_* environment variables found by lookup
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	for _, o := range envOverrides {
+		value, ok := lookup(o.name)
+		if !ok {
+			continue
+		}
+		if err := o.set(c, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", o.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitList splits a comma separated list
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Validate checks the settings that can be checked without parsing the templates,
+// all problems are reported at once
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Mode != "" && c.Mode != ModeKVP && c.Mode != ModeRESTful {
+		errs = append(errs, fmt.Errorf("mode: unknown mode %q, expected %s or %s", c.Mode, ModeKVP, ModeRESTful))
+	}
+	if len(c.Template) > 0 {
+		if _, err := os.Stat(c.Template); err != nil {
+			errs = append(errs, fmt.Errorf("template: %w", err))
+		}
+		if c.UpstreamCapabilities {
+			errs = append(errs, errors.New("template: use either a capabilities template or the upstream capabilities, not both"))
+		}
+	}
+	if c.CapabilitiesTTL < 0 {
+		errs = append(errs, errors.New("capabilitiesTTL: cannot be negative"))
+	}
+	if c.LogBuffer < 0 {
+		errs = append(errs, errors.New("logBuffer: cannot be negative"))
+	}
+	if c.ShutdownDelay < 0 {
+		errs = append(errs, errors.New("shutdownDelay: cannot be negative"))
+	}
+	if c.TileCacheSize < 0 {
+		errs = append(errs, errors.New("tileCacheSize: cannot be negative"))
+	}
+	if c.TileCacheTTL < 0 {
+		errs = append(errs, errors.New("tileCacheTTL: cannot be negative"))
+	}
+	if c.ReloadInterval < 0 {
+		errs = append(errs, errors.New("reloadInterval: cannot be negative"))
+	}
+	if (len(c.TLSCert) > 0) != (len(c.TLSKey) > 0) {
+		errs = append(errs, errors.New("tlsCert: needs both a certificate and a key file"))
+	}
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{{"readHeaderTimeout", c.ReadHeaderTimeout}, {"readTimeout", c.ReadTimeout}, {"writeTimeout", c.WriteTimeout}, {"idleTimeout", c.IdleTimeout},
+		{"upstreamConnectTimeout", c.ConnectTimeout}, {"upstreamResponseTimeout", c.ResponseTimeout}, {"circuitBreakerCooldown", c.BreakerCooldown}, {"corsMaxAge", c.CORSMaxAge}} {
+		if timeout.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: cannot be negative", timeout.name))
+		}
+	}
+	if c.Retries < 0 {
+		errs = append(errs, errors.New("upstreamRetries: cannot be negative"))
+	}
+	if c.BreakerFailures < 0 {
+		errs = append(errs, errors.New("circuitBreakerFailures: cannot be negative"))
+	}
+	for i, u := range c.Upstreams {
+		if len(u.Layer) == 0 || len(u.Host) == 0 {
+			errs = append(errs, fmt.Errorf("upstreams[%d]: needs a layer and a host", i))
+		}
+		if u.ConnectTimeout < 0 || u.ResponseTimeout < 0 {
+			errs = append(errs, fmt.Errorf("upstreams[%d]: timeouts cannot be negative", i))
+		}
+	}
+	if len(c.Upstreams) > 0 && c.UpstreamCapabilities {
+		// the capabilities of -host don't list the layers of the other upstreams
+		errs = append(errs, errors.New("upstreams: use a capabilities template with upstreams per layer, not the upstream capabilities"))
+	}
+	for i, l := range c.RateLimits {
+		if err := l.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rateLimits[%d]: %w", i, err))
+		}
+	}
+	if c.TrustedProxies < 0 {
+		errs = append(errs, errors.New("trustedProxies: cannot be negative"))
+	}
+	if len(c.AuthKeyFile) > 0 {
+		if _, err := os.Stat(c.AuthKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("authKeyFile: %w", err))
+		}
+	}
+	for i, p := range c.LayerPolicies {
+		if err := p.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("layerPolicies[%d]: %w", i, err))
+		}
+	}
+	if len(c.LayerPolicies) > 0 && len(c.Template) == 0 && !c.UpstreamCapabilities {
+		errs = append(errs, errors.New("layerPolicies: need a template or the upstream capabilities to filter the capabilities"))
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			errs = append(errs, fmt.Errorf("corsAllowedOrigins: invalid pattern %q: %w", origin, err))
+		}
+	}
+	if len(c.CORSAllowedOrigins) > 0 && len(c.CORSAllowedMethods) == 0 {
+		errs = append(errs, errors.New("corsAllowedMethods: needs at least one method"))
+	}
+	for i, d := range c.Dimensions {
+		if len(d.Identifier) == 0 {
+			errs = append(errs, fmt.Errorf("dimensions[%d]: has no identifier", i))
+		}
+	}
+	for format, extension := range c.FormatExtensions {
+		if len(format) == 0 || !strings.HasPrefix(extension, ".") {
+			errs = append(errs, fmt.Errorf("formats: %q=%q must map a format to an extension starting with a .", format, extension))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Init validates the config and parses the configured path templates,
+// an empty template results in the default template. When a capabilities
+// template is configured the ResourceURLs of its layers are used as well.
+func (c *Config) Init() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.initUpstreams(); err != nil {
+		return err
+	}
+
+	if len(c.AuthKeyFile) > 0 {
+		keys, err := loadAuthKeys(c.AuthKeyFile)
+		if err != nil {
+			return err
+		}
+		c.authKeys = keys
+	}
+
+	var err error
+	dimensions := dimensionPlaceholders(c.Dimensions)
+	c.tileTemplate, err = parsePathTemplate(valueOrDefault(c.TileTemplate, defaultTileTemplate), tileTemplatePlaceholders, dimensions)
+	if err != nil {
+		return fmt.Errorf("invalid GetTile template: %w", err)
+	}
+	c.featureInfoTemplate, err = parsePathTemplate(valueOrDefault(c.FeatureInfoTemplate, defaultFeatureInfoTemplate), featureInfoTemplatePlaceholders, dimensions)
+	if err != nil {
+		return fmt.Errorf("invalid GetFeatureInfo template: %w", err)
+	}
+	if c.UpstreamCapabilities {
+		if c.origin == nil {
+			return fmt.Errorf("upstream capabilities need a host")
+		}
+		c.upstreamCapabilities = newUpstreamCapabilities(c.CapabilitiesTTL, NewUpstreamTransport(func() *Config { return c }))
+	} else if len(c.Template) > 0 {
+		t, capabilities, err := loadCapabilities(c.Template)
+		if err != nil {
+			return err
+		}
+		c.capabilitiesTemplate = t
+		c.capabilities = capabilities
+		c.layerDimensions = capabilities.layerDimensions()
+		c.resourceTemplates, err = capabilities.resourceTemplates(c.getDimensions)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config that is safe to print, passwords in the hosts
+// and the token secret are replaced
+func (c *Config) Redacted() Config {
+	r := *c
+	if len(c.AuthTokenSecret) > 0 {
+		r.AuthTokenSecret = redacted
+	}
+	r.Host = redactURL(c.Host)
+	r.Upstreams = nil
+	for _, u := range c.Upstreams {
+		u.Host = redactURL(u.Host)
+		r.Upstreams = append(r.Upstreams, u)
+	}
+	return r
+}
+
+// redactURL replaces the password of an URL
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// String returns the effective config as YAML, with the secrets redacted
+func (c *Config) String() string {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// ByteSize is a size in bytes, it can be written with a unit like 256MB
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// Set parses the size, a number without unit is in bytes
+func (b *ByteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	unit := ByteSize(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.size
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q, expected a number with an optional unit B, KB, MB or GB", value)
+	}
+	*b = ByteSize(size) * unit
+	return nil
+}
+
+func (b ByteSize) String() string {
+	for _, u := range byteSizeUnits {
+		if b != 0 && b%u.size == 0 {
+			return strconv.FormatInt(int64(b/u.size), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// UnmarshalYAML reads the size from a number or a string with a unit
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	return b.Set(node.Value)
+}
+
+// MarshalYAML writes the size with the largest fitting unit
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	if b == 0 {
+		return 0, nil
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,139 @@
+package operations
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Default origins and methods allowed for cross-origin requests
+var (
+	defaultCORSAllowedOrigins = []string{"*"}
+	defaultCORSAllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+)
+
+// CORS answers the preflight requests and sets the CORS headers of every response, the
+// CORS headers of the upstream are replaced so all responses are consistent. Without
+// allowed origins no CORS headers are sent.
+type CORS struct {
+	config func() *Config
+}
+
+// NewCORS returns the CORS middleware for the config in use, config is called on every request
+func NewCORS(config func() *Config) *CORS {
+	return &CORS{config: config}
+}
+
+// Handler answers the preflight requests itself and passes all other requests on to next
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := c.config()
+		origin := r.Header.Get("Origin")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || len(origin) == 0 || len(method) == 0 {
+			next.ServeHTTP(&corsResponseWriter{ResponseWriter: w, config: config, origin: origin}, r)
+			return
+		}
+
+		// preflight request, without CORS headers in the response the browser refuses the request
+		header := w.Header()
+		if config.setCORSHeaders(header, origin) && config.corsMethodAllowed(method) {
+			header.Set("Access-Control-Allow-Methods", strings.Join(config.CORSAllowedMethods, ", "))
+			if headers := config.corsAllowedHeaders(r.Header.Get("Access-Control-Request-Headers")); len(headers) > 0 {
+				header.Set("Access-Control-Allow-Headers", headers)
+			}
+			if config.CORSMaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(config.CORSMaxAge.Seconds())))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// setCORSHeaders replaces the CORS headers in the header with the headers for the origin,
+// it returns false when the origin is not allowed
+func (c *Config) setCORSHeaders(header http.Header, origin string) bool {
+	for key := range header {
+		if strings.HasPrefix(key, "Access-Control-") {
+			delete(header, key)
+		}
+	}
+	if len(c.CORSAllowedOrigins) == 0 {
+		return false
+	}
+
+	allowOrigin := "*"
+	if !c.corsAnyOrigin() {
+		// the response depends on the origin
+		if !strings.Contains(strings.Join(header.Values("Vary"), ","), "Origin") {
+			header.Add("Vary", "Origin")
+		}
+		if len(origin) == 0 || !matchAny(c.CORSAllowedOrigins, origin, false) {
+			return false
+		}
+		allowOrigin = origin
+	}
+	header.Set("Access-Control-Allow-Origin", allowOrigin)
+	if len(c.CORSExposedHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(c.CORSExposedHeaders, ", "))
+	}
+	return true
+}
+
+// corsAnyOrigin tells if every origin is allowed
+func (c *Config) corsAnyOrigin() bool {
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) corsMethodAllowed(method string) bool {
+	for _, m := range c.CORSAllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsAllowedHeaders returns the allowed request headers, * allows the headers of the request
+// because a wildcard doesn't cover the Authorization header
+func (c *Config) corsAllowedHeaders(requested string) string {
+	for _, h := range c.CORSAllowedHeaders {
+		if h == "*" {
+			return requested
+		}
+	}
+	return strings.Join(c.CORSAllowedHeaders, ", ")
+}
+
+// corsResponseWriter replaces the CORS headers of the response when the header is written
+type corsResponseWriter struct {
+	http.ResponseWriter
+	config      *Config
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.config.setCORSHeaders(w.Header(), w.origin)
+		w.wroteHeader = code >= 200
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives the http.ResponseController access to the underlying ResponseWriter
+func (w *corsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,117 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	config := &Config{CORSAllowedOrigins: []string{"https://*.example.com"}, CORSAllowedMethods: defaultCORSAllowedMethods,
+		CORSAllowedHeaders: []string{"X-API-Key"}, CORSMaxAge: 10 * time.Minute}
+	handler := NewCORS(func() *Config { return config }).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected the preflight request to be answered locally")
+	}))
+
+	r := httptest.NewRequest("OPTIONS", "/wmts", nil)
+	r.Header.Set("Origin", "https://viewer.example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "x-api-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://viewer.example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Headers": "X-API-Key",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got: %d", w.Code)
+	}
+	for header, value := range expected {
+		if w.Header().Get(header) != value {
+			t.Errorf("Expected %s: %s, got: %q", header, value, w.Header().Get(header))
+		}
+	}
+
+	for origin, method := range map[string]string{"https://example.org": "GET", "https://viewer.example.com": "DELETE"} {
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") != "" {
+			t.Errorf("Expected the %s request from %s not to be allowed, got: %d %v", method, origin, w.Code, w.Header())
+		}
+	}
+}
+
+func TestCORSReplacesUpstreamHeaders(t *testing.T) {
+	config := &Config{CORSAllowedOrigins: []string{"https://viewer.example.com"}, CORSAllowedMethods: defaultCORSAllowedMethods, CORSExposedHeaders: []string{"X-Cache"}}
+	handler := NewCORS(func() *Config { return config }).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Write([]byte("tile"))
+	}))
+
+	for origin, allowed := range map[string]string{"https://viewer.example.com": "https://viewer.example.com", "https://example.org": ""} {
+		r := httptest.NewRequest("GET", "/wmts", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Header().Get("Access-Control-Allow-Origin") != allowed || w.Header().Get("Access-Control-Allow-Credentials") != "" || w.Header().Get("Vary") != "Origin" {
+			t.Errorf("Expected the upstream CORS headers to be replaced for %s, got: %v", origin, w.Header())
+		}
+	}
+	r := httptest.NewRequest("GET", "/wmts", nil)
+	r.Header.Set("Origin", "https://viewer.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Expose-Headers") != "X-Cache" {
+		t.Errorf("Expected the exposed headers, got: %v", w.Header())
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	config := NewConfig()
+	handler := NewCORS(func() *Config { return config }).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SendError(InvalidParameterValue("layer"), w, r)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/wmts", nil))
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || len(w.Header().Values("Vary")) != 0 {
+		t.Errorf("Expected every origin to be allowed by default, got: %v", w.Header())
+	}
+
+	config.CORSAllowedOrigins = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/wmts", nil))
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers without allowed origins, got: %v", w.Header())
+	}
+}
+
+func TestCORSTileCache(t *testing.T) {
+	config := &Config{CORSAllowedOrigins: []string{"https://a.example.com", "https://b.example.com"}, CORSAllowedMethods: defaultCORSAllowedMethods}
+	cache := NewTileCache(&Config{TileCacheSize: 1 << 20, TileCacheTTL: time.Minute}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tile"))
+	}))
+	handler := NewCORS(func() *Config { return config }).Handler(cache)
+
+	for _, origin := range []string{"https://a.example.com", "https://b.example.com"} {
+		r, info := WithRequestInfo(httptest.NewRequest("GET", "/wmts/brt/EPSG:28992/04/7/8.png", nil))
+		info.Operation = OperationGetTile
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Header().Get("Access-Control-Allow-Origin") != origin || len(w.Header().Values("Vary")) != 1 {
+			t.Errorf("Expected the CORS headers for %s, got: %v", origin, w.Header())
+		}
+	}
+	if cache.Stats().Hits != 1 {
+		t.Errorf("Expected the second request to be a cache hit, got: %+v", cache.Stats())
+	}
+}
@@ -0,0 +1,109 @@
+package operations
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Dimension of a layer, like TIME or ELEVATION. Layer is matched as a glob
+// pattern, an empty Layer applies the dimension to all layers.
+type Dimension struct {
+	Layer      string `yaml:"layer,omitempty"`
+	Identifier string `yaml:"identifier"`
+	Default    string `yaml:"default,omitempty"`
+}
+
+// ParseDimension parses a dimension in the form <layer>/<identifier>=<default>,
+// the layer and the default are optional. The default can contain slashes, like
+// an ISO 8601 interval.
+func ParseDimension(value string) (Dimension, error) {
+	var d Dimension
+	value, d.Default, _ = strings.Cut(value, "=")
+	if i := strings.LastIndex(value, "/"); i >= 0 {
+		d.Layer = value[:i]
+		value = value[i+1:]
+	}
+	d.Identifier = value
+
+	if len(d.Identifier) == 0 {
+		return d, fmt.Errorf("dimension %q has no identifier", value)
+	}
+	if _, err := path.Match(d.Layer, ""); err != nil {
+		return d, fmt.Errorf("dimension %s has an invalid layer pattern %q: %w", d.Identifier, d.Layer, err)
+	}
+	return d, nil
+}
+
+// matches checks if the dimension applies to the layer
+func (d Dimension) matches(layer string) bool {
+	if len(d.Layer) == 0 {
+		return true
+	}
+	ok, _ := path.Match(d.Layer, layer)
+	return ok
+}
+
+// getDimensions returns the dimensions of the layer, these are the dimensions from the
+// capabilities template combined with the configured dimensions. A configured dimension
+// overrides the dimension from the capabilities template with the same identifier.
+func (c *Config) getDimensions(layer string) []Dimension {
+	if c == nil {
+		return nil
+	}
+
+	var dimensions []Dimension
+	for _, d := range c.layerDimensions[layer] {
+		if !hasDimension(c.Dimensions, d.Identifier, layer) {
+			dimensions = append(dimensions, d)
+		}
+	}
+	for _, d := range c.Dimensions {
+		if d.matches(layer) {
+			dimensions = append(dimensions, d)
+		}
+	}
+	return dimensions
+}
+
+func hasDimension(dimensions []Dimension, identifier string, layer string) bool {
+	for _, d := range dimensions {
+		if strings.EqualFold(d.Identifier, identifier) && d.matches(layer) {
+			return true
+		}
+	}
+	return false
+}
+
+// dimensionPlaceholders returns the placeholder names of the dimensions
+func dimensionPlaceholders(dimensions []Dimension) []string {
+	var placeholders []string
+	for _, d := range dimensions {
+		placeholders = append(placeholders, strings.ToLower(d.Identifier))
+	}
+	return placeholders
+}
+
+// takeDimensions moves the dimension values from the query into the values used for
+// the path template. When a dimension is missing from the query its default is used.
+// Dimensions without a placeholder in the template are left in the query.
+func takeDimensions(query url.Values, dimensions []Dimension, t *pathTemplate, values map[string]string) {
+	for _, d := range dimensions {
+		placeholder := strings.ToLower(d.Identifier)
+		if !t.has(placeholder) {
+			continue
+		}
+		for key, v := range query {
+			if strings.ToLower(key) == placeholder {
+				if len(v) > 0 && len(v[0]) > 0 {
+					values[placeholder] = v[0]
+				}
+				delete(query, key)
+			}
+		}
+		if _, ok := values[placeholder]; !ok && len(d.Default) > 0 {
+			values[placeholder] = d.Default
+		}
+	}
+}
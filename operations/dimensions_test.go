@@ -0,0 +1,116 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseDimension(t *testing.T) {
+	expected := map[string]Dimension{
+		"Time":                               {Identifier: "Time"},
+		"Time=2024-01-01":                    {Identifier: "Time", Default: "2024-01-01"},
+		"weather_*/Elevation=0":              {Layer: "weather_*", Identifier: "Elevation", Default: "0"},
+		"weather/Time=2024-01-01":            {Layer: "weather", Identifier: "Time", Default: "2024-01-01"},
+		"Time=2020-01-01/2020-12-31":         {Identifier: "Time", Default: "2020-01-01/2020-12-31"},
+		"weather/Time=2020-01-01/2020-12-31": {Layer: "weather", Identifier: "Time", Default: "2020-01-01/2020-12-31"},
+	}
+
+	for input, dimension := range expected {
+		result, err := ParseDimension(input)
+		if err != nil {
+			t.Errorf("Got an error: %s", err)
+		}
+		if result != dimension {
+			t.Errorf("Expected %v but was not, got: %v", dimension, result)
+		}
+	}
+
+	if _, err := ParseDimension("weather/=1"); err == nil {
+		t.Errorf("Expected an error for a dimension without identifier")
+	}
+}
+
+func TestGetDimensions(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate", Dimensions: []Dimension{{Layer: "weather", Identifier: "TIME", Default: "2024-01-02"}, {Identifier: "Elevation", Default: "0"}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	dimensions := config.getDimensions("weather")
+	if len(dimensions) != 2 || dimensions[0].Default != "2024-01-02" || dimensions[1].Identifier != "Elevation" {
+		t.Errorf("Expected the configured dimensions TIME and Elevation, got: %v", dimensions)
+	}
+
+	dimensions = config.getDimensions("osm")
+	if len(dimensions) != 1 || dimensions[0].Identifier != "Elevation" {
+		t.Errorf("Expected the configured dimension Elevation, got: %v", dimensions)
+	}
+}
+
+func TestProcessGetTileRequestDimensions(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate", TileTemplate: "/{Layer}/{Elevation}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}{FileExtension}",
+		Dimensions: []Dimension{{Layer: "plain", Identifier: "Elevation"}, {Layer: "osm", Identifier: "Time"}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"service=WMTS&request=GetTile&version=1.0.0&layer=weather&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png&TIME=2024-01-02&testkey=testvalue": "local/weather/2024-01-02/GLOBAL_MERCATOR/01/1/0.png?testkey=testvalue",
+		"service=WMTS&request=GetTile&version=1.0.0&layer=weather&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png":                                   "local/weather/2024-01-01/GLOBAL_MERCATOR/01/1/0.png",
+		"service=WMTS&request=GetTile&version=1.0.0&layer=plain&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png&elevation=100":                       "local/plain/100/GLOBAL_MERCATOR/01/1/0.png",
+		"service=WMTS&request=GetTile&version=1.0.0&layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png&time=2024-01-02":                       "local/osm/GLOBAL_MERCATOR/01/0/1.png?time=2024-01-02",
+	}
+
+	for query, path := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local", RawQuery: query}, Header: http.Header{}}
+		if err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest); err != nil {
+			t.Fatalf("Got an error: %s", err)
+		}
+		if mockRequest.URL.String() != path {
+			t.Errorf("Expected %s but was not, got: %s", path, mockRequest.URL.String())
+		}
+	}
+}
+
+func TestProcessGetTileRequestMissingDimension(t *testing.T) {
+	config := &Config{TileTemplate: "/{Layer}/{Elevation}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}{FileExtension}",
+		Dimensions: []Dimension{{Identifier: "Elevation"}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+		RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=d&tilerow=e&format=image/png"}, Header: http.Header{}}
+	err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest)
+	if err == nil || err.Code() != "MissingParameterValue" {
+		t.Errorf("Expected MissingParameterValue, got: %v", err)
+	}
+}
+
+func TestProcessGetTileRequestIntervalDimension(t *testing.T) {
+	dimension, err := ParseDimension("weather/Time=2020-01-01/2020-12-31")
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	config := &Config{Template: "testCapabilitiesTemplate", Dimensions: []Dimension{dimension}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"":                            "local/weather/2020-01-01%2F2020-12-31/GLOBAL_MERCATOR/01/1/0.png",
+		"&TIME=2020-01-01/2020-06-30": "local/weather/2020-01-01%2F2020-06-30/GLOBAL_MERCATOR/01/1/0.png",
+	}
+	for time, path := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+			RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=weather&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png" + time}, Header: http.Header{}}
+		if err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest); err != nil {
+			t.Fatalf("Got an error for %q: %s", time, err)
+		}
+		if mockRequest.URL.String() != path {
+			t.Errorf("Expected %s but was not, got: %s", path, mockRequest.URL.String())
+		}
+	}
+}
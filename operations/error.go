@@ -15,20 +15,22 @@ const errorXML = `<?xml version="1.0"?>
                      xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
                      xsi:schemaLocation="http://www.opengis.net/ows/1.1 http://schemas.opengis.net/ows/1.1.0/owsExceptionReport.xsd"
                      version="1.0.0" xml:lang="en">
-    <ows:Exception exceptionCode="{{ .Code }}">
-        <ows:ExceptionText>{{ .Error }}</ows:ExceptionText>
+    <ows:Exception exceptionCode="{{ .Code }}"{{ with .Locator }} locator="{{ . | html }}"{{ end }}>
+        <ows:ExceptionText>{{ .Error | html }}</ows:ExceptionText>
     </ows:Exception>
 </ows:ExceptionReport>`
 
-// Exception interfact wraps three variables:
+// Exception interfact wraps four variables:
 // Error
 // Code
 // Status
+// Locator
 // Needed for WMTS error responses
 type Exception interface {
 	Error() string
 	Code() string
 	Status() int
+	Locator() string
 }
 
 // WMTSException grouping the error message variables together
@@ -36,6 +38,7 @@ type WMTSException struct {
 	ErrorMessage string
 	ErrorCode    string
 	StatusCode   int
+	ErrorLocator string
 }
 
 // Error returns available ErrorMessage
@@ -53,21 +56,68 @@ func (w WMTSException) Status() int {
 	return w.StatusCode
 }
 
+// Locator returns available ErrorLocator, the parameter causing the exception
+func (w WMTSException) Locator() string {
+	return w.ErrorLocator
+}
+
 // MissingParameterValue template
 func MissingParameterValue(value string) Exception {
 	return WMTSException{ErrorMessage: fmt.Sprintf("Missing parameter: %s", value),
-		ErrorCode: "MissingParameterValue", StatusCode: 400}
+		ErrorCode: "MissingParameterValue", StatusCode: 400, ErrorLocator: value}
 }
 
 // UnknownService template
 func UnknownService() Exception {
 	return WMTSException{ErrorMessage: "Missing SERVICE key or incorrect value",
-		ErrorCode: "MissingParameterValue", StatusCode: 400}
+		ErrorCode: "MissingParameterValue", StatusCode: 400, ErrorLocator: "service"}
 }
 
+// InvalidParameterValue template
 func InvalidParameterValue(parameter string) Exception {
 	return WMTSException{ErrorMessage: fmt.Sprintf("InvalidParameterValue for parameter: %s",
-		parameter), ErrorCode: "InvalidParameterValue", StatusCode: 400}
+		parameter), ErrorCode: "InvalidParameterValue", StatusCode: 400, ErrorLocator: parameter}
+}
+
+// TileOutOfRange template
+func TileOutOfRange(parameter string) Exception {
+	return WMTSException{ErrorMessage: fmt.Sprintf("TileOutOfRange for parameter: %s",
+		parameter), ErrorCode: "TileOutOfRange", StatusCode: 400, ErrorLocator: parameter}
+}
+
+// PointIJOutOfRange template
+func PointIJOutOfRange(parameter string) Exception {
+	return WMTSException{ErrorMessage: fmt.Sprintf("PointIJOutOfRange for parameter: %s",
+		parameter), ErrorCode: "PointIJOutOfRange", StatusCode: 400, ErrorLocator: parameter}
+}
+
+// OperationNotSupported template
+func OperationNotSupported(operation string) Exception {
+	return WMTSException{ErrorMessage: fmt.Sprintf("Operation not supported: %s",
+		operation), ErrorCode: "OperationNotSupported", StatusCode: 501, ErrorLocator: operation}
+}
+
+// VersionNegotiationFailed template
+func VersionNegotiationFailed(versions string) Exception {
+	return WMTSException{ErrorMessage: fmt.Sprintf("None of the accepted versions is supported: %s",
+		versions), ErrorCode: "VersionNegotiationFailed", StatusCode: 400, ErrorLocator: "acceptversions"}
+}
+
+// InvalidUpdateSequence template
+func InvalidUpdateSequence(updateSequence string) Exception {
+	return WMTSException{ErrorMessage: fmt.Sprintf("UpdateSequence is greater than the current value: %s",
+		updateSequence), ErrorCode: "InvalidUpdateSequence", StatusCode: 400, ErrorLocator: "updatesequence"}
+}
+
+// NotPermitted template, for a value the client is not permitted to request
+func NotPermitted(parameter string) Exception {
+	return WMTSException{ErrorMessage: fmt.Sprintf("Value not permitted for parameter: %s",
+		parameter), ErrorCode: "InvalidParameterValue", StatusCode: 403, ErrorLocator: parameter}
+}
+
+// NoApplicableCode template
+func NoApplicableCode(message string) Exception {
+	return WMTSException{ErrorMessage: message, ErrorCode: "NoApplicableCode", StatusCode: 500}
 }
 
 // SendError writes the error message to the response
@@ -76,8 +126,9 @@ func SendError(e Exception, w http.ResponseWriter, r *http.Request) {
 	errorXMLTemplate := template.Must(template.New("errorXML").Parse(errorXML))
 	errorXMLTemplate.Execute(buf, e)
 
-	w.WriteHeader(e.Status())
+	exceptionsTotal.WithLabelValues(e.Code()).Inc()
 	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status())
 	w.Write([]byte(buf.Bytes()))
 }
 
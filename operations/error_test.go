@@ -72,3 +72,50 @@ func TestMissingParameterValue(t *testing.T) {
 		t.Errorf("Error should contain: %s, got: %s", s, err.Error())
 	}
 }
+
+func TestSendErrorLocator(t *testing.T) {
+	w := httptest.NewRecorder()
+	SendError(InvalidParameterValue("<tilecol>"), w, &http.Request{})
+
+	expected := `exceptionCode="InvalidParameterValue" locator="&lt;tilecol&gt;"`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("Expected %s but was not, got: %s", expected, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/xml" {
+		t.Errorf("Expected Content-Type application/xml but was not, got: %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestSendErrorNoLocator(t *testing.T) {
+	w := httptest.NewRecorder()
+	SendError(NoApplicableCode("upstream failed"), w, &http.Request{})
+
+	if strings.Contains(w.Body.String(), "locator=") {
+		t.Errorf("Expected no locator, got: %s", w.Body.String())
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected statuscode %d but was not, got: %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestExceptionCodes(t *testing.T) {
+	expected := map[string]struct {
+		exception Exception
+		status    int
+		locator   string
+	}{
+		"TileOutOfRange":           {TileOutOfRange("tilerow"), 400, "tilerow"},
+		"OperationNotSupported":    {OperationNotSupported("GetLegendGraphic"), 501, "GetLegendGraphic"},
+		"VersionNegotiationFailed": {VersionNegotiationFailed("2.0.0"), 400, "acceptversions"},
+		"InvalidUpdateSequence":    {InvalidUpdateSequence("5"), 400, "updatesequence"},
+		"NoApplicableCode":         {NoApplicableCode("error"), 500, ""},
+		"MissingParameterValue":    {MissingParameterValue("layer"), 400, "layer"},
+	}
+
+	for code, e := range expected {
+		if e.exception.Code() != code || e.exception.Status() != e.status || e.exception.Locator() != e.locator {
+			t.Errorf("Expected %s, %d, %s but was not, got: %s, %d, %s", code, e.status, e.locator,
+				e.exception.Code(), e.exception.Status(), e.exception.Locator())
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package operations
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Default mapping of GetTile formats to the file extension of the RESTful path
+var defaultFormatExtensions = map[string]string{
+	"image/png":                          ".png",
+	"image/jpgpng":                       ".png",
+	"image/png8":                         ".png",
+	"image/png; mode=8bit":               ".png",
+	"image/png; mode=24bit":              ".png",
+	"image/jpeg":                         ".jpeg",
+	"image/webp":                         ".webp",
+	"application/vnd.mapbox-vector-tile": ".pbf",
+}
+
+// ParseFormatExtension parses a format mapping in the form <format>=<extension>,
+// the format itself can contain a = so the last one is used as separator
+func ParseFormatExtension(value string) (string, string, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return "", "", fmt.Errorf("format mapping %q must be in the form <format>=<extension>", value)
+	}
+	extension := value[i+1:]
+	if !strings.HasPrefix(extension, ".") {
+		extension = "." + extension
+	}
+	return value[:i], extension, nil
+}
+
+// normalizeFormat lowercases the format and removes the spaces,
+// so image/png;mode=8bit and image/png; mode=8bit are the same
+func normalizeFormat(format string) string {
+	return strings.ToLower(strings.ReplaceAll(format, " ", ""))
+}
+
+// getFileExtension returns the file extension for the GetTile format, a configured
+// mapping takes precedence over the default mapping
+func (c *Config) getFileExtension(format string) (string, Exception) {
+	normalized := normalizeFormat(format)
+	if c != nil {
+		for f, extension := range c.FormatExtensions {
+			if normalizeFormat(f) == normalized {
+				return extension, nil
+			}
+		}
+	}
+	for f, extension := range defaultFormatExtensions {
+		if normalizeFormat(f) == normalized {
+			return extension, nil
+		}
+	}
+	return "", InvalidParameterValue("format")
+}
+
+// getFormat returns the GetTile format for the file extension, the reverse of getFileExtension.
+// A configured mapping takes precedence, when several formats share the extension the format
+// named after the extension is used, so .png results in image/png, or else the first one in
+// alphabetical order.
+func (c *Config) getFormat(fileExtension string) (string, Exception) {
+	if c != nil {
+		if format, ok := firstFormat(c.FormatExtensions, fileExtension); ok {
+			return format, nil
+		}
+	}
+	if format, ok := firstFormat(defaultFormatExtensions, fileExtension); ok {
+		return format, nil
+	}
+	return "", InvalidParameterValue("format")
+}
+
+func firstFormat(formatExtensions map[string]string, fileExtension string) (string, bool) {
+	var formats []string
+	for format, extension := range formatExtensions {
+		if strings.EqualFold(extension, fileExtension) {
+			formats = append(formats, format)
+		}
+	}
+	if len(formats) == 0 {
+		return "", false
+	}
+	named := func(format string) bool {
+		_, subtype, _ := strings.Cut(format, "/")
+		return strings.EqualFold(subtype, strings.TrimPrefix(fileExtension, "."))
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		if named(formats[i]) != named(formats[j]) {
+			return named(formats[i])
+		}
+		return formats[i] < formats[j]
+	})
+	return formats[0], true
+}
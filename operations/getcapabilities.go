@@ -2,7 +2,10 @@ package operations
 
 import (
 	"bytes"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"text/template"
@@ -54,8 +57,11 @@ func hostAndPath(r *http.Request) HostAndPath {
 
 // GetCapabilitiesTemplate usage the path to return the template file
 // and builds a template
-func getCapabilitiesTemplate(path string) (*template.Template, Exception) {
-	var capabilitiesTemplate = template.Must(template.ParseFiles(path))
+func getCapabilitiesTemplate(path string) (*template.Template, error) {
+	capabilitiesTemplate, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse capabilities template: %w", err)
+	}
 	return capabilitiesTemplate, nil
 }
 
@@ -64,25 +70,89 @@ func getCapabilitiesKeys() []string {
 	return []string{"service", "request", "version"}
 }
 
-// ProcessGetCapabilitiesRequest if a template is given this will
-// fill it in and writes it to the response
+// negotiateVersion checks if 1.0.0 is one of the versions in the optional AcceptVersions parameter
+func negotiateVersion(query url.Values) Exception {
+	if len(query["acceptversions"]) == 0 || len(query["acceptversions"][0]) == 0 {
+		return nil
+	}
+	for _, v := range strings.Split(query["acceptversions"][0], ",") {
+		if strings.TrimSpace(v) == "1.0.0" {
+			return nil
+		}
+	}
+	return VersionNegotiationFailed(query["acceptversions"][0])
+}
+
+// checkUpdateSequence checks if the optional UpdateSequence parameter is not greater than the
+// updateSequence of the capabilities, values are compared as numbers when possible
+func checkUpdateSequence(query url.Values, c *capabilities) Exception {
+	if len(query["updatesequence"]) == 0 || c == nil || len(c.UpdateSequence) == 0 {
+		return nil
+	}
+	requested := query["updatesequence"][0]
+
+	r, rerr := strconv.ParseFloat(requested, 64)
+	u, uerr := strconv.ParseFloat(c.UpdateSequence, 64)
+	if (rerr == nil && uerr == nil && r > u) || ((rerr != nil || uerr != nil) && requested > c.UpdateSequence) {
+		return InvalidUpdateSequence(requested)
+	}
+	return nil
+}
+
+// ProcessGetCapabilitiesRequest if a template is given, or the capabilities are
+// fetched from the upstream, this will fill it in and writes it to the response
 func ProcessGetCapabilitiesRequest(config *Config, w http.ResponseWriter, r *http.Request) Exception {
+	var t *template.Template
+	var c *capabilities
+	if config.UpstreamCapabilities {
+		cached, err := config.upstreamCapabilities.get(config.origin, r.URL.Path)
+		if err != nil {
+			return WMTSException{ErrorMessage: "Could not retrieve the capabilities from the upstream", ErrorCode: "NoApplicableCode", StatusCode: 502}
+		}
+		t, c = cached.template, cached.capabilities
+	} else {
+		t, c = config.capabilitiesTemplate, config.capabilities
+		if t == nil {
+			// the config was not initialised with the template
+			var err error
+			if t, err = getCapabilitiesTemplate(config.Template); err != nil {
+				log.Println(err)
+				return WMTSException{ErrorMessage: "Could not load the capabilities template", ErrorCode: "NoApplicableCode", StatusCode: 500}
+			}
+		}
+	}
+
+	wmtskeys, _ := splitQueryKeys(r.URL.Query(), []string{"acceptversions", "updatesequence"})
+	if err := negotiateVersion(wmtskeys); err != nil {
+		return err
+	}
+	if err := checkUpdateSequence(wmtskeys, c); err != nil {
+		return err
+	}
+
 	buf := new(bytes.Buffer)
-	t, _ := getCapabilitiesTemplate(config.Template)
 	t.Execute(buf, hostAndPath(r))
 
+	// only the layers permitted to the client are listed
+	document, err := config.filterCapabilities(buf.Bytes(), requestClient(r))
+	if err != nil {
+		log.Println(err)
+		return NoApplicableCode("Could not filter the capabilities")
+	}
+
 	// Content-length header is needed for applications like QGIS
 	// Maybe nicer way in calc capabilities documents size
 	// For 'normal' size capabilities documents impact is low
-	capabilities := buf.String()
+	capabilities := string(document)
 
+	if len(config.LayerPolicies) > 0 {
+		w.Header().Set("Cache-Control", "private")
+	}
 	w.Header().Set("Server", "wmts-kvp-to-restful")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Content-Type", "application/xml")
 	w.Header().Set("Content-length", strconv.Itoa(len(capabilities)))
 
-	t.Execute(buf, hostAndPath(r))
 	w.Write([]byte(capabilities))
 
 	return nil
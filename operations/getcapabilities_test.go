@@ -181,3 +181,26 @@ func TestProcessGetCapabilitiesRequest(t *testing.T) {
 	}
 	defer resp.Body.Close()
 }
+
+func TestProcessGetCapabilitiesRequestNegotiation(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"AcceptVersions=2.0.0":       "VersionNegotiationFailed",
+		"AcceptVersions=2.0.0,1.0.0": "",
+		"UpdateSequence=4":           "InvalidUpdateSequence",
+		"UpdateSequence=3":           "",
+	}
+
+	for query, code := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts",
+			RawQuery: "service=WMTS&request=GetCapabilities&" + query}, Header: http.Header{}}
+		err := ProcessGetCapabilitiesRequest(config, httptest.NewRecorder(), mockRequest)
+		if (code == "" && err != nil) || (code != "" && (err == nil || err.Code() != code)) {
+			t.Errorf("Expected %q for %s but was not, got: %v", code, query, err)
+		}
+	}
+}
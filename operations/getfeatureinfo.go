@@ -1,32 +1,41 @@
 package operations
 
 import (
-	"bytes"
 	"net/http"
 	"net/url"
-	"regexp"
-	"strings"
-	"text/template"
 )
 
-var getFeatureInfoRegex = regexp.MustCompile(`^.*:(.*)$`)
-
-const getFeatureInfoRestTemplate = `/{{ .Layer }}/{{ .TileMatrixSet }}/{{ .TileMatrix }}/{{ .TileCol }}/{{ .TileRow }}/{{ .I }}/{{ .J }}{{ .FileExtension }}`
-
 // ProcessGetFeatureInfoRequest - Translates KVP requests to RestFUL requests
-func ProcessGetFeatureInfoRequest(w http.ResponseWriter, r *http.Request) Exception {
-	wmtskeys, otherkeys := splitQueryKeys(r.URL.Query(), getFeatureInfoKeys())
+func ProcessGetFeatureInfoRequest(config *Config, w http.ResponseWriter, r *http.Request) Exception {
+	wmtskeys, otherkeys := splitQueryKeys(r.URL.Query(), append(getFeatureInfoKeys(), optionalKeys()...))
 	err := missingKeys(wmtskeys, getFeatureInfoKeys())
 	if err != nil {
 		return err
 	}
 
-	url, err := getFeatureInfoQueryToPath(wmtskeys)
+	layer := wmtskeys["layer"][0]
+	setTile(r, layer, wmtskeys["tilematrixset"][0], wmtskeys["tilematrix"][0], wmtskeys["tilecol"][0], wmtskeys["tilerow"][0])
+	if err := config.checkPolicy(r, layer, wmtskeys["tilematrixset"][0]); err != nil {
+		return err
+	}
+	capabilities := config.getCapabilities(r.URL.Path)
+	if capabilities != nil {
+		err = capabilities.validate(resourceTypeFeatureInfo, wmtskeys, stripTileMatrixPrefix(wmtskeys["tilematrix"][0]))
+		if err != nil {
+			return err
+		}
+	}
+
+	values := map[string]string{"style": config.getLayerStyle(capabilities, wmtskeys)}
+	t := config.getFeatureInfoTemplate(layer, wmtskeys["infoformat"][0])
+	takeDimensions(otherkeys, config.getDimensions(layer), t, values)
+
+	url, err := getFeatureInfoQueryToPath(t, wmtskeys, values)
 	if err != nil {
 		return err
 	}
 
-	r.URL.Path = strings.TrimRight(r.URL.Path, "/") + url
+	t.resolve(r.URL, url)
 	if len(otherkeys) > 0 {
 		r.URL.RawQuery = formatKeysToQueryString(otherkeys)
 	} else {
@@ -35,38 +44,29 @@ func ProcessGetFeatureInfoRequest(w http.ResponseWriter, r *http.Request) Except
 	return nil
 }
 
-func getFeatureInfoQueryToPath(query url.Values) (string, Exception) {
-
-	type RestParameters struct {
-		Layer         string
-		TileMatrixSet string
-		TileMatrix    string
-		TileCol       string
-		TileRow       string
-		I             string
-		J             string
-		FileExtension string
-	}
-
-	tilematrix := query["tilematrix"][0]
-	groups := getFeatureInfoRegex.FindAllStringSubmatch(tilematrix, -1)
-	if groups != nil {
-		tilematrix = groups[0][1]
+// getFeatureInfoQueryToPath fills in the path template with the WMTS query values,
+// values holds the style and dimensions already taken from the request
+func getFeatureInfoQueryToPath(t *pathTemplate, query url.Values, values map[string]string) (string, Exception) {
+	tilematrix := stripTileMatrixPrefix(query["tilematrix"][0])
+
+	values["layer"] = query["layer"][0]
+	values["tilematrixset"] = query["tilematrixset"][0]
+	values["tilematrix"] = tilematrix
+	values["tilecol"] = query["tilecol"][0]
+	values["tilerow"] = query["tilerow"][0]
+	values["i"] = query["i"][0]
+	values["j"] = query["j"][0]
+
+	// A ResourceURL template belongs to a single info format and has no need for the extension
+	if t.has("fileextension") {
+		fileExtension, err := parseFileExtension(query["infoformat"][0])
+		if err != nil {
+			return "", err
+		}
+		values["fileextension"] = fileExtension
 	}
 
-	fileExtension, err := parseFileExtension(query["infoformat"][0])
-	if err != nil {
-		return "", err
-	}
-
-	restParameters := &RestParameters{Layer: query["layer"][0], TileMatrixSet: query["tilematrixset"][0],
-		TileMatrix: tilematrix, TileCol: query["tilecol"][0], TileRow: query["tilerow"][0],
-		I: query["i"][0], J: query["j"][0], FileExtension: fileExtension}
-
-	buf := new(bytes.Buffer)
-	template.Must(template.New("getFeatureInfoResttemplate").Parse(getFeatureInfoRestTemplate)).Execute(buf, restParameters)
-
-	return buf.String(), nil
+	return t.expand(values)
 }
 
 func parseFileExtension(format string) (string, Exception) {
@@ -87,6 +87,25 @@ func parseFileExtension(format string) (string, Exception) {
 	return fileExtension, nil
 }
 
+// parseInfoFormat is the reverse of parseFileExtension
+func parseInfoFormat(fileExtension string) (string, Exception) {
+
+	infoFormat := fileExtension
+	switch infoFormat {
+	case ".txt":
+		infoFormat = "plain/text"
+	case ".html":
+		infoFormat = "text/html"
+	case ".json":
+		infoFormat = "application/json"
+	case ".xml":
+		infoFormat = "text/xml"
+	default:
+		return "", InvalidParameterValue("infoformat")
+	}
+	return infoFormat, nil
+}
+
 // GetCapabilitiesKeys list of manitory WMTS gettile key value pairs
 func getFeatureInfoKeys() []string {
 	return []string{"service", "request", "version", "layer", "tilematrixset", "tilematrix", "tilecol", "tilerow", "i", "j", "infoformat"}
@@ -32,17 +32,17 @@ func TestProcessGetFeatureInfoRequest(t *testing.T) {
 		Host:   "example.com",
 		URL: &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetFeatureInfo&version=1.0.0" +
 			"&layer=achtergrondvisualisatie&tilematrixset=EPSG:28992&tilematrix=14" +
-			"&tilecol=col&tilerow=row&infoformat=plain/text&j=1&i=2&testkey=testvalue"},
+			"&tilecol=7&tilerow=8&infoformat=plain/text&j=1&i=2&testkey=testvalue"},
 		Header:     http.Header{},
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		RemoteAddr: "192.0.2.1:1234",
 	}
-	expected := "local/achtergrondvisualisatie/EPSG:28992/14/col/row/2/1.txt?testkey=testvalue"
+	expected := "local/achtergrondvisualisatie/EPSG:28992/14/7/8/2/1.txt?testkey=testvalue"
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ProcessGetFeatureInfoRequest(w, mockRequest)
+			ProcessGetFeatureInfoRequest(&Config{}, w, mockRequest)
 		}))
 	defer ts.Close()
 
@@ -60,7 +60,7 @@ func TestProcessGetFeatureInfoRequestMissingKeys(t *testing.T) {
 		Host:   "example.com",
 		URL: &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetFeatureInfo&version=1.0.0" +
 			"&layer=achtergrondvisualisatie&tilematrix=14" +
-			"&tilecol=col&tilerow=row&infoformat=text/plain&j=1&i=2&testkey=testvalue"},
+			"&tilecol=7&tilerow=8&infoformat=text/plain&j=1&i=2&testkey=testvalue"},
 		Header:     http.Header{},
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
@@ -70,7 +70,7 @@ func TestProcessGetFeatureInfoRequestMissingKeys(t *testing.T) {
 	expected := "Missing parameter: tilematrixset"
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			err = ProcessGetTileRequest(w, mockRequest)
+			err = ProcessGetTileRequest(&Config{}, w, mockRequest)
 		}))
 	defer ts.Close()
 
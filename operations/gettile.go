@@ -1,51 +1,45 @@
 package operations
 
 import (
-	"bytes"
 	"net/http"
 	"net/url"
 	"regexp"
-	"strings"
-	"text/template"
 )
 
 var regex = regexp.MustCompile(`^.*:(.*)$`)
 
-const restTemplate = `/{{ .Layer }}/{{ .Tilematrixset }}/{{ .Tilematrix }}/{{ .Tilecol }}/{{ .Tilerow }}{{ .Fileextension }}`
-
-func tileQueryToPath(query url.Values) string {
-
-	type RestParameters struct {
-		Layer         string
-		Tilematrixset string
-		Tilematrix    string
-		Tilecol       string
-		Tilerow       string
-		Fileextension string
-	}
-
-	tilematrix := query["tilematrix"][0]
+// stripTileMatrixPrefix removes the tilematrixset prefix GeoWebCache puts in front of the tilematrix
+func stripTileMatrixPrefix(tilematrix string) string {
 	groups := regex.FindAllStringSubmatch(tilematrix, -1)
 	if groups != nil {
-		tilematrix = groups[0][1]
+		return groups[0][1]
 	}
+	return tilematrix
+}
 
-	var fileExtension string
-	switch query["format"][0] {
-	case "image/png8":
-		fileExtension = ".png"
-	case "image/jpeg":
-		fileExtension = ".jpeg"
-	default:
-		fileExtension = ".png"
-	}
+// tileQueryToPath fills in the path template for the layer and format with the WMTS
+// query values, values holds the style and dimensions already taken from the request
+func tileQueryToPath(config *Config, query url.Values, values map[string]string) (string, Exception) {
+	t := config.getTileTemplate(query["layer"][0], query["format"][0])
+
+	tilematrix := stripTileMatrixPrefix(query["tilematrix"][0])
 
-	restParameters := &RestParameters{Layer: query["layer"][0], Tilematrixset: query["tilematrixset"][0], Tilematrix: tilematrix, Tilecol: query["tilecol"][0], Tilerow: query["tilerow"][0], Fileextension: fileExtension}
+	values["layer"] = query["layer"][0]
+	values["tilematrixset"] = query["tilematrixset"][0]
+	values["tilematrix"] = tilematrix
+	values["tilecol"] = query["tilecol"][0]
+	values["tilerow"] = query["tilerow"][0]
 
-	buf := new(bytes.Buffer)
-	template.Must(template.New("restTemplate").Parse(restTemplate)).Execute(buf, restParameters)
+	// A ResourceURL template belongs to a single format and has no need for the extension
+	if t.has("fileextension") {
+		fileExtension, err := config.getFileExtension(query["format"][0])
+		if err != nil {
+			return "", err
+		}
+		values["fileextension"] = fileExtension
+	}
 
-	return buf.String()
+	return t.expand(values)
 }
 
 // GetCapabilitiesKeys list of manitory WMTS gettile key value pairs
@@ -55,14 +49,36 @@ func getTileKeys() []string {
 
 // ProcessGetTileRequest rewrites the KVP request as RestFUL
 // and alters the request so it can be proxied
-func ProcessGetTileRequest(w http.ResponseWriter, r *http.Request) Exception {
-	wmtskeys, otherkeys := splitQueryKeys(r.URL.Query(), getTileKeys())
+func ProcessGetTileRequest(config *Config, w http.ResponseWriter, r *http.Request) Exception {
+	wmtskeys, otherkeys := splitQueryKeys(r.URL.Query(), append(getTileKeys(), optionalKeys()...))
 	err := missingKeys(wmtskeys, getTileKeys())
 	if err != nil {
 		return err
 	}
 
-	r.URL.Path = strings.TrimRight(r.URL.Path, "/") + tileQueryToPath(wmtskeys)
+	layer := wmtskeys["layer"][0]
+	setTile(r, layer, wmtskeys["tilematrixset"][0], wmtskeys["tilematrix"][0], wmtskeys["tilecol"][0], wmtskeys["tilerow"][0])
+	if err := config.checkPolicy(r, layer, wmtskeys["tilematrixset"][0]); err != nil {
+		return err
+	}
+	capabilities := config.getCapabilities(r.URL.Path)
+	if capabilities != nil {
+		err = capabilities.validate(resourceTypeTile, wmtskeys, stripTileMatrixPrefix(wmtskeys["tilematrix"][0]))
+		if err != nil {
+			return err
+		}
+	}
+
+	values := map[string]string{"style": config.getLayerStyle(capabilities, wmtskeys)}
+	t := config.getTileTemplate(layer, wmtskeys["format"][0])
+	takeDimensions(otherkeys, config.getDimensions(layer), t, values)
+
+	path, err := tileQueryToPath(config, wmtskeys, values)
+	if err != nil {
+		return err
+	}
+
+	t.resolve(r.URL, path)
 	if len(otherkeys) > 0 {
 		r.URL.RawQuery = formatKeysToQueryString(otherkeys)
 	} else {
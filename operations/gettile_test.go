@@ -13,17 +13,17 @@ func TestProcessGetTileRequest(t *testing.T) {
 	var mockRequest = &http.Request{
 		Method:     "GET",
 		Host:       "example.com",
-		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=d&tilerow=e&format=f&testkey=testvalue"},
+		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/png&testkey=testvalue"},
 		Header:     http.Header{},
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		RemoteAddr: "192.0.2.1:1234",
 	}
-	expected := "local/a/b/c/d/e.png?testkey=testvalue"
+	expected := "local/a/b/c/4/5.png?testkey=testvalue"
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ProcessGetTileRequest(w, mockRequest)
+			ProcessGetTileRequest(&Config{}, w, mockRequest)
 		}))
 	defer ts.Close()
 
@@ -38,17 +38,17 @@ func TestProcessGetTileRequestLongerPath(t *testing.T) {
 	var mockRequest = &http.Request{
 		Method:     "GET",
 		Host:       "subdomain.example.org",
-		URL:        &url.URL{Path: "local/a/path", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=e&tilematrixset=d&tilematrix=d:c&tilecol=b&tilerow=a&format=image/png&testkey=testvalue"},
+		URL:        &url.URL{Path: "local/a/path", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=e&tilematrixset=d&tilematrix=d:c&tilecol=2&tilerow=1&format=image/png&testkey=testvalue"},
 		Header:     http.Header{},
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		RemoteAddr: "192.0.2.1:1234",
 	}
-	expected := "local/a/path/e/d/c/b/a.png?testkey=testvalue"
+	expected := "local/a/path/e/d/c/2/1.png?testkey=testvalue"
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ProcessGetTileRequest(w, mockRequest)
+			ProcessGetTileRequest(&Config{}, w, mockRequest)
 		}))
 	defer ts.Close()
 
@@ -64,7 +64,7 @@ func TestProcessGetTileRequestMissingKeys(t *testing.T) {
 	var mockRequest = &http.Request{
 		Method:     "GET",
 		Host:       "example.com",
-		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrix=c&tilecol=d&tilerow=e&format=f"},
+		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrix=c&tilecol=4&tilerow=5&format=f"},
 		Header:     http.Header{},
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
@@ -74,7 +74,7 @@ func TestProcessGetTileRequestMissingKeys(t *testing.T) {
 	expected := "Missing parameter: tilematrixset"
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			err = ProcessGetTileRequest(w, mockRequest)
+			err = ProcessGetTileRequest(&Config{}, w, mockRequest)
 		}))
 	defer ts.Close()
 
@@ -89,17 +89,17 @@ func TestProcessGetTileRequestNoRawQuery(t *testing.T) {
 	var mockRequest = &http.Request{
 		Method:     "GET",
 		Host:       "example.com",
-		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=d&tilerow=e&format=f"},
+		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/png"},
 		Header:     http.Header{},
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		RemoteAddr: "192.0.2.1:1234",
 	}
-	expected := "local/a/b/c/d/e.png"
+	expected := "local/a/b/c/4/5.png"
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ProcessGetTileRequest(w, mockRequest)
+			ProcessGetTileRequest(&Config{}, w, mockRequest)
 		}))
 	defer ts.Close()
 
@@ -127,7 +127,7 @@ func TestHappyFlow(t *testing.T) {
 
 	query := map[string][]string{"layer": {layer}, "tilematrixset": {tilematrixset}, "tilematrix": {tilematrix}, "tilecol": {tilecol}, "tilerow": {tilerow}, "format": {format}}
 
-	newpath := tileQueryToPath(query)
+	newpath, _ := tileQueryToPath(&Config{}, query, map[string]string{})
 	expectednewpath := "/" + layer + "/" + tilematrixset + "/" + tilematrix + "/" + tilecol + "/" + tilerow + ".png"
 
 	if newpath != expectednewpath {
@@ -146,7 +146,7 @@ func TestGWCTileMatrixIssue(t *testing.T) {
 
 	query := map[string][]string{"layer": {layer}, "tilematrixset": {tilematrixset}, "tilematrix": {gwctilematrixprefix + tilematrix}, "tilecol": {tilecol}, "tilerow": {tilerow}, "format": {format}}
 
-	newpath := tileQueryToPath(query)
+	newpath, _ := tileQueryToPath(&Config{}, query, map[string]string{})
 	expectednewpath := "/" + layer + "/" + tilematrixset + "/" + tilematrix + "/" + tilecol + "/" + tilerow + ".png"
 
 	if newpath != expectednewpath {
@@ -165,7 +165,7 @@ func TestObscureGWCTileMatrixIssue(t *testing.T) {
 
 	query := map[string][]string{"layer": {layer}, "tilematrixset": {tilematrixset}, "tilematrix": {gwctilematrixprefix + tilematrix}, "tilecol": {tilecol}, "tilerow": {tilerow}, "format": {format}}
 
-	newpath := tileQueryToPath(query)
+	newpath, _ := tileQueryToPath(&Config{}, query, map[string]string{})
 	expectednewpath := "/" + layer + "/" + tilematrixset + "/" + tilematrix + "/" + tilecol + "/" + tilerow + ".png"
 
 	if newpath != expectednewpath {
@@ -183,7 +183,7 @@ func TestImagePng8FormatMapping(t *testing.T) {
 
 	query := map[string][]string{"layer": {layer}, "tilematrixset": {tilematrixset}, "tilematrix": {tilematrix}, "tilecol": {tilecol}, "tilerow": {tilerow}, "format": {format}}
 
-	newpath := tileQueryToPath(query)
+	newpath, _ := tileQueryToPath(&Config{}, query, map[string]string{})
 	expectednewpath := "/" + layer + "/" + tilematrixset + "/" + tilematrix + "/" + tilecol + "/" + tilerow + ".png"
 
 	if newpath != expectednewpath {
@@ -201,10 +201,152 @@ func TestImageJpegFormatMapping(t *testing.T) {
 
 	query := map[string][]string{"layer": {layer}, "tilematrixset": {tilematrixset}, "tilematrix": {tilematrix}, "tilecol": {tilecol}, "tilerow": {tilerow}, "format": {format}}
 
-	newpath := tileQueryToPath(query)
+	newpath, _ := tileQueryToPath(&Config{}, query, map[string]string{})
 	expectednewpath := "/" + layer + "/" + tilematrixset + "/" + tilematrix + "/" + tilecol + "/" + tilerow + ".jpeg"
 
 	if newpath != expectednewpath {
 		t.Errorf("Request was incorrect, got: %s, want: %s.", newpath, expectednewpath)
 	}
 }
+
+func TestProcessGetTileRequestConfiguredTemplate(t *testing.T) {
+	var mockRequest = &http.Request{
+		Method:     "GET",
+		Host:       "example.com",
+		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/jpeg"},
+		Header:     http.Header{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		RemoteAddr: "192.0.2.1:1234",
+	}
+	config := &Config{TileTemplate: "/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}{FileExtension}"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := "local/b/c/5/4.jpeg"
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ProcessGetTileRequest(config, w, mockRequest)
+		}))
+	defer ts.Close()
+
+	http.Get(ts.URL)
+
+	if mockRequest.URL.String() != expected {
+		t.Errorf("Expected %s but was not, got: %s", expected, mockRequest.URL.String())
+	}
+}
+
+func TestProcessGetTileRequestStyle(t *testing.T) {
+	config := &Config{TileTemplate: "/{Layer}/{Style}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}{FileExtension}", DefaultStyle: "standaard"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"service=WMTS&request=GetTile&version=1.0.0&layer=a&style=grijs&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/png": "local/a/grijs/b/c/4/5.png",
+		"service=WMTS&request=GetTile&version=1.0.0&layer=a&style=&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/png":      "local/a/standaard/b/c/4/5.png",
+		"service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/png":             "local/a/standaard/b/c/4/5.png",
+	}
+
+	for query, path := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local", RawQuery: query}, Header: http.Header{}}
+		if err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest); err != nil {
+			t.Fatalf("Got an error: %s", err)
+		}
+		if mockRequest.URL.String() != path {
+			t.Errorf("Expected %s but was not, got: %s", path, mockRequest.URL.String())
+		}
+	}
+}
+
+func TestProcessGetTileRequestStyleNotInTemplate(t *testing.T) {
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+		RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&STYLE=grijs&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/png"}, Header: http.Header{}}
+	expected := "local/a/b/c/4/5.png"
+
+	if err := ProcessGetTileRequest(&Config{}, httptest.NewRecorder(), mockRequest); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if mockRequest.URL.String() != expected {
+		t.Errorf("Expected %s but was not, got: %s", expected, mockRequest.URL.String())
+	}
+}
+
+func TestFormatMapping(t *testing.T) {
+	expected := map[string]string{
+		"image/png":                          ".png",
+		"image/png; mode=8bit":               ".png",
+		"image/png;mode=8bit":                ".png",
+		"image/webp":                         ".webp",
+		"application/vnd.mapbox-vector-tile": ".pbf",
+		"image/jpgpng":                       ".jpgpng",
+		"image/jpeg":                         ".jpg",
+	}
+	config := &Config{FormatExtensions: map[string]string{"image/jpgpng": ".jpgpng", "image/jpeg": ".jpg"}}
+
+	for format, extension := range expected {
+		result, err := config.getFileExtension(format)
+		if err != nil {
+			t.Errorf("Got an error for %s: %s", format, err)
+		}
+		if result != extension {
+			t.Errorf("Expected %s for %s but was not, got: %s", extension, format, result)
+		}
+	}
+
+	if result, err := (&Config{}).getFileExtension("image/jpgpng"); err != nil || result != ".png" {
+		t.Errorf("Expected .png for image/jpgpng by default, got: %s %v", result, err)
+	}
+}
+
+func TestProcessGetTileRequestUnknownFormat(t *testing.T) {
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+		RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/gif"}, Header: http.Header{}}
+
+	err := ProcessGetTileRequest(&Config{}, httptest.NewRecorder(), mockRequest)
+	if err == nil || err.Code() != "InvalidParameterValue" || !strings.Contains(err.Error(), "format") {
+		t.Errorf("Expected InvalidParameterValue for format, got: %v", err)
+	}
+}
+
+func TestParseFormatExtension(t *testing.T) {
+	format, extension, err := ParseFormatExtension("image/png; mode=8bit=png")
+	if err != nil || format != "image/png; mode=8bit" || extension != ".png" {
+		t.Errorf("Expected image/png; mode=8bit and .png, got: %s, %s, %v", format, extension, err)
+	}
+
+	if _, _, err := ParseFormatExtension("image/png"); err == nil {
+		t.Errorf("Expected an error for a mapping without extension")
+	}
+}
+
+func TestProcessGetTileRequestPathTraversal(t *testing.T) {
+	expected := map[string]string{
+		"layer=../../admin&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5":        "layer",
+		"layer=a&tilematrixset=b/../..&tilematrix=c&tilecol=4&tilerow=5":            "tilematrixset",
+		"layer=a&tilematrixset=b&tilematrix=c&tilecol=4/../../5&tilerow=5":          "tilecol",
+		"layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=-5":                 "tilerow",
+		"layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&style=..":         "style",
+		"layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&time=../../admin": "time",
+	}
+
+	config := &Config{TileTemplate: "/{Layer}/{Style}/{Time}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}{FileExtension}",
+		Dimensions: []Dimension{{Identifier: "Time", Default: "2020-01-01/2020-12-31"}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	for query, locator := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+			RawQuery: "service=WMTS&request=GetTile&version=1.0.0&format=image/png&" + query}, Header: http.Header{}}
+		err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest)
+		if err == nil || err.Code() != "InvalidParameterValue" || err.Locator() != locator {
+			t.Errorf("Expected InvalidParameterValue for %s, got: %v", locator, err)
+		}
+		if mockRequest.URL.Path != "local" {
+			t.Errorf("Expected the path not to be rewritten, got: %s", mockRequest.URL.Path)
+		}
+	}
+}
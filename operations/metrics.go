@@ -0,0 +1,123 @@
+package operations
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Operation label for requests that are not a WMTS operation and are proxied unchanged
+const operationPassthrough = "passthrough"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmts_requests_total",
+		Help: "Number of handled requests by WMTS operation, status code, layer and tile matrix set.",
+	}, []string{"operation", "code", "layer", "tilematrixset"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wmts_request_duration_seconds",
+		Help:    "Total duration of the handled requests by WMTS operation, status code, layer and tile matrix set.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "code", "layer", "tilematrixset"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wmts_upstream_request_duration_seconds",
+		Help:    "Duration of the requests to the upstream until the response headers are received, by WMTS operation and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+
+	exceptionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmts_exceptions_total",
+		Help: "Number of OWS exceptions returned by exception code.",
+	}, []string{"exception_code"})
+)
+
+// InstrumentRequests records the number and duration of the requests handled by next. The layer
+// and tile matrix set are only recorded for successful requests, so invalid values don't end up
+// as labels. The request passed on to next has a RequestInfo.
+func InstrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := GetRequestInfo(r)
+		if info == nil {
+			r, info = WithRequestInfo(r)
+		}
+
+		start := time.Now()
+		srw := &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(srw, r)
+
+		operation := valueOrDefault(info.Operation, operationPassthrough)
+		var layer, tileMatrixSet string
+		if srw.statusCode < http.StatusBadRequest {
+			layer, tileMatrixSet = info.Layer, info.TileMatrixSet
+		}
+		code := strconv.Itoa(srw.statusCode)
+		requestsTotal.WithLabelValues(operation, code, layer, tileMatrixSet).Inc()
+		requestDuration.WithLabelValues(operation, code, layer, tileMatrixSet).Observe(time.Since(start).Seconds())
+	})
+}
+
+// InstrumentTransport records the duration of the requests to the upstream done by next,
+// the duration is also kept in the RequestInfo
+func InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	return instrumentedTransport{next: next}
+}
+
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	info := GetRequestInfo(r)
+	operation := operationPassthrough
+	if info != nil {
+		operation = valueOrDefault(info.Operation, operationPassthrough)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	elapsed := time.Since(start)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamDuration.WithLabelValues(operation, code).Observe(elapsed.Seconds())
+	if info != nil {
+		info.UpstreamDuration = elapsed
+	}
+	return resp, err
+}
+
+// statusResponseWriter keeps the status code and the number of bytes written to the ResponseWriter
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.statusCode = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap gives the http.ResponseController access to the underlying ResponseWriter
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,86 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInstrumentRequests(t *testing.T) {
+	config := &Config{Host: "http://default"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	handler := InstrumentRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ProcessRequest(config, w, r) {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+
+	valid := requestsTotal.WithLabelValues(OperationGetTile, "200", "metrics", "EPSG:28992")
+	invalid := requestsTotal.WithLabelValues(OperationGetTile, "400", "", "")
+	passthrough := requestsTotal.WithLabelValues(operationPassthrough, "200", "", "")
+	before := []float64{testutil.ToFloat64(valid), testutil.ToFloat64(invalid), testutil.ToFloat64(passthrough)}
+
+	for _, query := range []string{
+		"service=WMTS&request=GetTile&version=1.0.0&layer=metrics&tilematrixset=EPSG:28992&tilematrix=0&tilecol=0&tilerow=0&format=image/png",
+		"service=WMTS&request=GetTile&version=1.0.0&layer=metrics&tilematrixset=EPSG:28992&tilematrix=0&tilecol=0&tilerow=0&format=image/gif",
+		"",
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts", RawQuery: query}, Header: http.Header{}})
+	}
+
+	after := []float64{testutil.ToFloat64(valid), testutil.ToFloat64(invalid), testutil.ToFloat64(passthrough)}
+	for i, name := range []string{"valid", "invalid", "passthrough"} {
+		if after[i]-before[i] != 1 {
+			t.Errorf("Expected 1 %s request to be counted, got: %v", name, after[i]-before[i])
+		}
+	}
+}
+
+func TestSendErrorCountsExceptions(t *testing.T) {
+	counter := exceptionsTotal.WithLabelValues("TileOutOfRange")
+	before := testutil.ToFloat64(counter)
+
+	SendError(TileOutOfRange("tilerow"), httptest.NewRecorder(), &http.Request{})
+	if testutil.ToFloat64(counter)-before != 1 {
+		t.Errorf("Expected the TileOutOfRange exception to be counted")
+	}
+}
+
+// observations returns the number of observations of the histogram
+func observations(t *testing.T, observer prometheus.Observer) uint64 {
+	var m dto.Metric
+	if err := observer.(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInstrumentTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	histogram := upstreamDuration.WithLabelValues(OperationGetFeatureInfo, "404")
+	before := observations(t, histogram)
+
+	r, info := WithRequestInfo(httptest.NewRequest("GET", server.URL+"/wmts/transport", nil))
+	info.Operation = OperationGetFeatureInfo
+	r.RequestURI = ""
+	resp, err := InstrumentTransport(http.DefaultTransport).RoundTrip(r)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	resp.Body.Close()
+
+	if observations(t, histogram)-before != 1 {
+		t.Errorf("Expected the upstream request to be observed")
+	}
+}
@@ -7,11 +7,58 @@ import (
 	"strings"
 )
 
-// Config used for storing application startup parameters
-type Config struct {
-	Host     string
-	Template string
-	Logging  bool
+// Style used when a request has no or an empty STYLE parameter
+const defaultStyle = "default"
+
+// getTileTemplate returns the GetTile path template for the layer and format,
+// this is the ResourceURL from the capabilities template when available. Otherwise the
+// configured template is used, or the default template if the config is not initialised.
+func (c *Config) getTileTemplate(layer string, format string) *pathTemplate {
+	if c == nil {
+		return defaultTilePathTemplate
+	}
+	if t, ok := c.resourceTemplates.get(layer, resourceTypeTile, format); ok {
+		return t
+	}
+	if c.tileTemplate == nil {
+		return defaultTilePathTemplate
+	}
+	return c.tileTemplate
+}
+
+// getFeatureInfoTemplate returns the GetFeatureInfo path template for the layer and info format,
+// this is the ResourceURL from the capabilities template when available. Otherwise the
+// configured template is used, or the default template if the config is not initialised.
+func (c *Config) getFeatureInfoTemplate(layer string, infoFormat string) *pathTemplate {
+	if c == nil {
+		return defaultFeatureInfoPathTemplate
+	}
+	if t, ok := c.resourceTemplates.get(layer, resourceTypeFeatureInfo, infoFormat); ok {
+		return t
+	}
+	if c.featureInfoTemplate == nil {
+		return defaultFeatureInfoPathTemplate
+	}
+	return c.featureInfoTemplate
+}
+
+// getStyle returns the requested style, or the default style
+// when the STYLE parameter is missing or empty
+func (c *Config) getStyle(query url.Values) string {
+	if len(query["style"]) > 0 && len(query["style"][0]) > 0 {
+		return query["style"][0]
+	}
+	if c == nil {
+		return defaultStyle
+	}
+	return valueOrDefault(c.DefaultStyle, defaultStyle)
+}
+
+func valueOrDefault(value string, def string) string {
+	if len(value) == 0 {
+		return def
+	}
+	return value
 }
 
 // Convert all the keys to lowercase and checks if there is only
@@ -21,7 +68,7 @@ func keysToLowerAndFilter(query url.Values) (url.Values, Exception) {
 
 	for key, values := range query {
 		if len(values) != 1 {
-			return nil, WMTSException{ErrorMessage: fmt.Sprintf("Multiple query values found for key: %s", key), ErrorCode: "InvalidParameterValue", StatusCode: 400}
+			return nil, WMTSException{ErrorMessage: fmt.Sprintf("Multiple query values found for key: %s", key), ErrorCode: "InvalidParameterValue", StatusCode: 400, ErrorLocator: key}
 		}
 		newquery[strings.ToLower(key)] = values
 	}
@@ -56,16 +103,16 @@ func splitQueryKeys(query url.Values, filter []string) (url.Values, url.Values)
 	return newWMTSQuery, noneWMTSQuery
 }
 
-// formatKeysToQueryString takes a map and builds a query string
+// formatKeysToQueryString takes a map and builds a URL encoded query string, sorted by key
+// so the same parameters always result in the same query string
 func formatKeysToQueryString(query url.Values) string {
-	querystring := ""
-	for key, values := range query {
+	return query.Encode()
+}
 
-		for _, v := range values {
-			querystring = querystring + fmt.Sprintf("%s=%s&", key, v)
-		}
-	}
-	return strings.TrimRight(querystring, "&")
+// optionalKeys list of optional WMTS key value pairs used
+// by the gettile and getfeatureinfo requests
+func optionalKeys() []string {
+	return []string{"style"}
 }
 
 // missingKeys checks if there are key-value pairs missing
@@ -82,6 +129,14 @@ func missingKeys(query url.Values, keys []string) Exception {
 // ProcessRequest checks the quality of the request
 // and if it's valid to process as a WMTS request
 func ProcessRequest(config *Config, w http.ResponseWriter, r *http.Request) bool {
+	if !processRequest(config, w, r) {
+		return false
+	}
+	config.setUpstream(r)
+	return true
+}
+
+func processRequest(config *Config, w http.ResponseWriter, r *http.Request) bool {
 
 	// check if it's a WMTS request
 	query, err := keysToLowerAndFilter(r.URL.Query())
@@ -89,7 +144,8 @@ func ProcessRequest(config *Config, w http.ResponseWriter, r *http.Request) bool
 		SendError(err, w, r)
 		return false
 	} else if len(query["service"]) < 1 || len(query["request"]) < 1 {
-		return true
+		// a RESTful request passed through is routed by its layer and has to be permitted as well
+		return config.passRESTfulRequest(w, r)
 	} else if len(query["service"]) > 0 && strings.ToLower(query["service"][0]) != "wmts" {
 		SendError(UnknownService(), w, r)
 		return false
@@ -98,14 +154,16 @@ func ProcessRequest(config *Config, w http.ResponseWriter, r *http.Request) bool
 	// check what WMTS request and process
 	switch strings.ToLower(query["request"][0]) {
 	case "gettile":
-		err := ProcessGetTileRequest(w, r)
+		setOperation(r, OperationGetTile)
+		err := ProcessGetTileRequest(config, w, r)
 		if err != nil {
 			SendError(err, w, r)
 			return false
 		}
 		return true
 	case "getcapabilities":
-		if len(config.Host) < 1 {
+		setOperation(r, OperationGetCapabilities)
+		if len(config.Template) < 1 && !config.UpstreamCapabilities {
 			return true
 		}
 		err := ProcessGetCapabilitiesRequest(config, w, r)
@@ -115,13 +173,15 @@ func ProcessRequest(config *Config, w http.ResponseWriter, r *http.Request) bool
 		}
 		return false
 	case "getfeatureinfo":
-		err := ProcessGetFeatureInfoRequest(w, r)
+		setOperation(r, OperationGetFeatureInfo)
+		err := ProcessGetFeatureInfoRequest(config, w, r)
 		if err != nil {
 			SendError(err, w, r)
 			return false
 		}
 		return true
 	default:
-		return true
+		SendError(OperationNotSupported(query["request"][0]), w, r)
+		return false
 	}
 }
@@ -28,6 +28,15 @@ func getBodyAsString(b io.ReadCloser) string {
 	return string(bodyBytes)
 }
 
+// testConfig initialises the config and returns it as the config in use of a middleware
+func testConfig(t *testing.T, config *Config) func() *Config {
+	t.Helper()
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	return func() *Config { return config }
+}
+
 func TestKeysToLowerAndFilter(t *testing.T) {
 	input := map[string][]string{"A": {"B"}, "D": {"e"}}
 	expected := map[string][]string{"a": {"B"}, "d": {"e"}}
@@ -100,6 +109,55 @@ func TestFormatKeysToQueryString(t *testing.T) {
 	}
 }
 
+func TestFormatKeysToQueryStringOrder(t *testing.T) {
+	input := map[string][]string{"z": {"1"}, "a": {"2", "1"}, "M": {"3"}}
+	expected := "M=3&a=2&a=1&z=1"
+
+	for i := 0; i < 10; i++ {
+		if result := formatKeysToQueryString(input); result != expected {
+			t.Errorf("Expected %s, but got: %s", expected, result)
+		}
+	}
+}
+
+func TestFormatKeysToQueryStringRoundTrip(t *testing.T) {
+	expected := []url.Values{
+		{"token": {"a=b&c=d"}},
+		{"vendor": {"with space", "plus+sign"}},
+		{"naam": {"Dijkstraße ĳ 🗺"}},
+		{"sig": {"YWJj/ZGVm+Z2hp=="}, "expires": {"1700000000"}},
+		{"percent": {"100%"}, "hash": {"#fragment"}, "semicolon": {"a;b"}},
+		{"empty": {""}},
+	}
+
+	for _, query := range expected {
+		result, err := url.ParseQuery(formatKeysToQueryString(query))
+		if err != nil || !reflect.DeepEqual(result, query) {
+			t.Errorf("Expected %v after the round-trip, got: %v %v", query, result, err)
+		}
+	}
+}
+
+func TestProcessRequestForwardsEncodedParameters(t *testing.T) {
+	config := &Config{Host: "http://localhost"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	token := "a=b&c=d e+f/ü"
+	query := url.Values{"service": {"WMTS"}, "request": {"GetTile"}, "version": {"1.0.0"}, "layer": {"a"}, "tilematrixset": {"b"},
+		"tilematrix": {"c"}, "tilecol": {"1"}, "tilerow": {"2"}, "format": {"image/png"}, "token": {token}, "vendor": {"x"}}
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts", RawQuery: query.Encode()}, Header: http.Header{}}
+
+	if !ProcessRequest(config, httptest.NewRecorder(), mockRequest) {
+		t.Fatalf("Expected the request to be proxied")
+	}
+	expected := url.Values{"token": {token}, "vendor": {"x"}}.Encode()
+	if mockRequest.URL.Query().Get("token") != token || mockRequest.URL.RawQuery != expected {
+		t.Errorf("Expected the encoded token and vendor parameters in order, got: %s", mockRequest.URL.RawQuery)
+	}
+}
+
 func TestMissingKeys(t *testing.T) {
 	input := map[string][]string{"a": {"B", "1"}, "c": {"D", "2"}, "E": {"3"}}
 	keys := []string{"a", "c"}
@@ -203,3 +261,24 @@ func TestProcessRequestUnknownService(t *testing.T) {
 		t.Errorf("Expected %s but was not, got: %s", expected, body)
 	}
 }
+
+func TestProcessRequestOperationNotSupported(t *testing.T) {
+	var mockRequest = &http.Request{
+		Method:     "GET",
+		Host:       "example.com",
+		URL:        &url.URL{Path: "local", RawQuery: "service=WMTS&request=GetLegendGraphic"},
+		Header:     http.Header{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		RemoteAddr: "192.0.2.1:1234",
+	}
+	w := httptest.NewRecorder()
+
+	if ProcessRequest(&Config{}, w, mockRequest) {
+		t.Errorf("Expected the request not to be proxied")
+	}
+	if w.Code != http.StatusNotImplemented || !strings.Contains(w.Body.String(), `locator="GetLegendGraphic"`) {
+		t.Errorf("Expected OperationNotSupported for GetLegendGraphic, got: %d %s", w.Code, w.Body.String())
+	}
+}
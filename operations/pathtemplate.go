@@ -0,0 +1,256 @@
+package operations
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Default RESTful path templates, placeholders are named as in the WMTS ResourceURL
+const (
+	defaultTileTemplate        = `/{Layer}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}{FileExtension}`
+	defaultFeatureInfoTemplate = `/{Layer}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}/{I}/{J}{FileExtension}`
+)
+
+// Placeholders that can be used in a path template. FileExtension is not
+// part of the WMTS spec, it is filled with the extension of the requested format.
+var knownPlaceholders = []string{"layer", "style", "tilematrixset", "tilematrix", "tilecol", "tilerow", "i", "j", "fileextension"}
+
+// Placeholders that must be present in the path templates
+var (
+	tileTemplatePlaceholders        = []string{"tilematrix", "tilecol", "tilerow"}
+	featureInfoTemplatePlaceholders = []string{"tilematrix", "tilecol", "tilerow", "i", "j"}
+)
+
+// Placeholders filled in with values checked against a pattern, so a value cannot change the
+// upstream path. The values of the other placeholders, the dimensions, cannot contain a / or \
+// and are escaped when the path is sent.
+var (
+	integerPlaceholders    = []string{"tilecol", "tilerow", "i", "j"}
+	identifierPlaceholders = []string{"layer", "style", "tilematrixset", "tilematrix"}
+)
+
+var (
+	integerRegex    = regexp.MustCompile(`^[0-9]+$`)
+	identifierRegex = regexp.MustCompile(`^[\p{L}\p{N}_.:~@+-]+$`)
+)
+
+// Parsed default templates, used when no templates are configured
+var (
+	defaultTilePathTemplate        = mustParsePathTemplate(defaultTileTemplate, tileTemplatePlaceholders)
+	defaultFeatureInfoPathTemplate = mustParsePathTemplate(defaultFeatureInfoTemplate, featureInfoTemplatePlaceholders)
+)
+
+// pathTemplate is a parsed RESTful path template like
+// /{Layer}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}.png
+type pathTemplate struct {
+	raw      string
+	segments []templateSegment
+	pattern  *regexp.Regexp
+	// absolute is set for a ResourceURL with a fixed host, its path replaces the request path
+	absolute bool
+}
+
+// templateSegment is either a literal part of the path
+// or a placeholder, placeholders are stored in lowercase
+type templateSegment struct {
+	literal     string
+	placeholder string
+}
+
+// parsePathTemplate parses the raw template and checks if all the required
+// placeholders are present. Besides the known placeholders the template can
+// contain placeholders for the given dimensions.
+func parsePathTemplate(raw string, required []string, dimensions []string) (*pathTemplate, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return nil, fmt.Errorf("path template %q must start with a /", raw)
+	}
+
+	t := &pathTemplate{raw: raw}
+	rest := raw
+	for len(rest) > 0 {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.segments = append(t.segments, templateSegment{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("path template %q has an unexpected }", raw)
+		}
+		if open > 0 {
+			t.segments = append(t.segments, templateSegment{literal: rest[:open]})
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("path template %q has an unclosed placeholder", raw)
+		}
+		name := strings.ToLower(rest[open+1 : open+1+end])
+		if len(name) == 0 {
+			return nil, fmt.Errorf("path template %q has an empty placeholder", raw)
+		}
+		if !contains(knownPlaceholders, name) && !contains(dimensions, name) {
+			return nil, fmt.Errorf("path template %q has an unknown placeholder {%s}", raw, rest[open+1:open+1+end])
+		}
+		t.segments = append(t.segments, templateSegment{placeholder: name})
+		rest = rest[open+end+2:]
+	}
+
+	for _, name := range required {
+		if !t.has(name) {
+			return nil, fmt.Errorf("path template %q is missing the placeholder for %s", raw, name)
+		}
+	}
+
+	pattern, err := t.compile()
+	if err != nil {
+		return nil, fmt.Errorf("path template %q cannot be matched: %w", raw, err)
+	}
+	t.pattern = pattern
+	return t, nil
+}
+
+// compile builds the regular expression used to match a RESTful path against the template,
+// the first group is the path before the template. A placeholder matches a single path
+// segment, except for FileExtension which matches the extension at the end of a segment.
+func (t *pathTemplate) compile() (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`^(.*?)`)
+	for _, s := range t.segments {
+		switch s.placeholder {
+		case "":
+			b.WriteString(regexp.QuoteMeta(s.literal))
+		case "fileextension":
+			b.WriteString(`(\.[^/.]+)`)
+		default:
+			b.WriteString(`([^/]+?)`)
+		}
+	}
+	b.WriteString(`$`)
+	return regexp.Compile(b.String())
+}
+
+// mustParsePathTemplate is like parsePathTemplate but panics when the template is invalid
+func mustParsePathTemplate(raw string, required []string) *pathTemplate {
+	t, err := parsePathTemplate(raw, required, nil)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// resolve sets the path of the rewritten request to the expanded, escaped, template path
+func (t *pathTemplate) resolve(u *url.URL, path string) {
+	if !t.absolute {
+		path = strings.TrimRight(u.EscapedPath(), "/") + path
+	}
+	u.Path, _ = url.PathUnescape(path)
+	u.RawPath = path
+}
+
+// has checks if the placeholder is used in the template
+func (t *pathTemplate) has(placeholder string) bool {
+	for _, s := range t.segments {
+		if s.placeholder == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+// expand fills in the placeholders with the given values,
+// the keys of the values are the lowercase placeholder names
+func (t *pathTemplate) expand(values map[string]string) (string, Exception) {
+	var b strings.Builder
+	for _, s := range t.segments {
+		if len(s.placeholder) == 0 {
+			b.WriteString(s.literal)
+			continue
+		}
+		v, ok := values[s.placeholder]
+		if !ok {
+			return "", MissingParameterValue(s.placeholder)
+		}
+		if err := checkPathValue(s.placeholder, v); err != nil {
+			return "", err
+		}
+		// a dimension value like an interval can contain a /, it is kept within its segment
+		b.WriteString(url.PathEscape(v))
+	}
+	return b.String(), nil
+}
+
+// match matches the path against the template, it returns the part of the path before
+// the template and the values of the placeholders
+func (t *pathTemplate) match(path string) (string, map[string]string, bool) {
+	groups := t.pattern.FindStringSubmatch(path)
+	if groups == nil {
+		return "", nil, false
+	}
+
+	values := map[string]string{}
+	i := 2
+	for _, s := range t.segments {
+		if len(s.placeholder) == 0 {
+			continue
+		}
+		if v, ok := values[s.placeholder]; ok && v != groups[i] {
+			// the same placeholder is used twice with different values
+			return "", nil, false
+		}
+		values[s.placeholder] = groups[i]
+		i++
+	}
+	return groups[1], values, true
+}
+
+// checkPathValue checks if the value of the placeholder is safe to put in the path: integers
+// are non-negative, identifiers consist of safe characters and no part of a value between the
+// slashes is empty or a . or .. segment, as an escaped / can be decoded before the path is
+// cleaned. Other values are path escaped by expand.
+func checkPathValue(placeholder string, value string) Exception {
+	switch {
+	case placeholder == "fileextension":
+		// taken from the config, not from the request
+		return nil
+	case !validPathSegments(value):
+		return InvalidParameterValue(placeholder)
+	case contains(integerPlaceholders, placeholder):
+		if !integerRegex.MatchString(value) {
+			return InvalidParameterValue(placeholder)
+		}
+	case contains(identifierPlaceholders, placeholder):
+		if !identifierRegex.MatchString(value) {
+			return InvalidParameterValue(placeholder)
+		}
+	default:
+		if strings.Contains(value, "\\") || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return InvalidParameterValue(placeholder)
+		}
+	}
+	return nil
+}
+
+// validPathSegments checks if none of the parts of the value between the slashes is empty, . or ..
+func validPathSegments(value string) bool {
+	for _, segment := range strings.Split(value, "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *pathTemplate) String() string {
+	return t.raw
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package operations
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	tmpl, err := parsePathTemplate("/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png", tileTemplatePlaceholders, nil)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	result, exception := tmpl.expand(map[string]string{"tilematrixset": "EPSG:28992", "tilematrix": "4", "tilecol": "5", "tilerow": "6"})
+	if exception != nil {
+		t.Fatalf("Got an error: %s", exception)
+	}
+
+	expected := "/EPSG:28992/4/6/5.png"
+	if result != expected {
+		t.Errorf("Expected %s but was not, got: %s", expected, result)
+	}
+}
+
+func TestParsePathTemplateCaseInsensitive(t *testing.T) {
+	tmpl, err := parsePathTemplate("/{layer}/{TILEMATRIX}/{tilecol}/{TileRow}", tileTemplatePlaceholders, nil)
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if !tmpl.has("layer") || !tmpl.has("tilematrix") {
+		t.Errorf("Expected placeholders layer and tilematrix in: %s", tmpl)
+	}
+}
+
+func TestParsePathTemplateInvalid(t *testing.T) {
+	invalid := map[string]string{
+		"{Layer}/{TileMatrix}/{TileCol}/{TileRow}":            "must start with a /",
+		"/{Layer}/{TileMatrix}/{TileCol}/{TileRow":            "unclosed placeholder",
+		"/{Layer}/{TileMatrix}/{TileCol}/TileRow}":            "unexpected }",
+		"/{Layer}/{}/{TileMatrix}/{TileCol}/{TileRow}":        "empty placeholder",
+		"/{Layer}/{Unknown}/{TileMatrix}/{TileCol}/{TileRow}": "unknown placeholder {Unknown}",
+		"/{Layer}/{TileMatrix}/{TileCol}":                     "missing the placeholder for tilerow",
+	}
+
+	for raw, expected := range invalid {
+		_, err := parsePathTemplate(raw, tileTemplatePlaceholders, nil)
+		if err == nil {
+			t.Errorf("Expected an error for %s but got none", raw)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %s but was not, got: %s", expected, err)
+		}
+	}
+}
+
+func TestParsePathTemplateDimension(t *testing.T) {
+	tmpl, err := parsePathTemplate("/{Layer}/{Time}/{TileMatrix}/{TileCol}/{TileRow}.png", tileTemplatePlaceholders, []string{"time"})
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if !tmpl.has("time") {
+		t.Errorf("Expected placeholder time in: %s", tmpl)
+	}
+}
+
+func TestConfigInitInvalidTemplate(t *testing.T) {
+	config := &Config{TileTemplate: "/{Layer}/{TileMatrix}"}
+	err := config.Init()
+	if err == nil || !strings.Contains(err.Error(), "GetTile") {
+		t.Errorf("Expected an invalid GetTile template error, got: %v", err)
+	}
+}
+
+func TestPathTemplateMatch(t *testing.T) {
+	tmpl := mustParsePathTemplate(defaultTileTemplate, tileTemplatePlaceholders)
+
+	prefix, values, ok := tmpl.match("/tiles/service/wmts/brtachtergrondkaart/EPSG:28992/04/7/8.png")
+	if !ok {
+		t.Fatalf("Expected the path to match %s", tmpl)
+	}
+	if prefix != "/tiles/service/wmts" {
+		t.Errorf("Expected prefix /tiles/service/wmts but was not, got: %s", prefix)
+	}
+
+	expected := map[string]string{"layer": "brtachtergrondkaart", "tilematrixset": "EPSG:28992", "tilematrix": "04", "tilecol": "7", "tilerow": "8", "fileextension": ".png"}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("Expected %s for %s but was not, got: %s", v, k, values[k])
+		}
+	}
+
+	if _, _, ok := tmpl.match("/EPSG:28992/04/7.png"); ok {
+		t.Errorf("Expected a path with too few segments not to match")
+	}
+	if _, _, ok := tmpl.match("/tiles/service/wmts/brtachtergrondkaart/EPSG:28992/04/7/8"); ok {
+		t.Errorf("Expected a path without extension not to match")
+	}
+}
+
+func TestCheckPathValue(t *testing.T) {
+	valid := map[string][]string{
+		"tilecol":       {"0", "12345"},
+		"i":             {"255"},
+		"layer":         {"brtachtergrondkaart", "top10nl_v2", "grijs-2.0", "Luchtfoto~actueel"},
+		"tilematrixset": {"EPSG:28992", "urn:ogc:def:crs:EPSG::3857"},
+		"elevation":     {"-10.5", "2024-01-02T00:00:00Z", "with space", "2020-01-01/2020-12-31"},
+	}
+	for placeholder, values := range valid {
+		for _, v := range values {
+			if err := checkPathValue(placeholder, v); err != nil {
+				t.Errorf("Expected %q to be valid for %s, got: %s", v, placeholder, err)
+			}
+		}
+	}
+
+	invalid := map[string][]string{
+		"tilecol":    {"", "-1", "1/2", "+1", "1.0", "0x1"},
+		"j":          {"a"},
+		"layer":      {"..", ".", "../../admin", "a/b", "a\\b", "a%2Fb", "a b", "a?b"},
+		"tilematrix": {"04/../..", "04#"},
+		"elevation":  {"..", "1\\2", "1\n2", "../../admin", "2020/..", "/2020", "2020/", "2020//2021", "2020/./2021"},
+	}
+	for placeholder, values := range invalid {
+		for _, v := range values {
+			if err := checkPathValue(placeholder, v); err == nil || err.Code() != "InvalidParameterValue" || err.Locator() != placeholder {
+				t.Errorf("Expected %q to be invalid for %s, got: %v", v, placeholder, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+)
+
+// LayerPolicy permits the clients matching one of the Clients glob patterns the layers
+// matching Allow and not matching Deny, in the tile matrix sets matching TileMatrixSets.
+// An empty Clients, Allow or TileMatrixSets list matches everything.
+type LayerPolicy struct {
+	Clients        []string `yaml:"clients,omitempty"`
+	Allow          []string `yaml:"allow,omitempty"`
+	Deny           []string `yaml:"deny,omitempty"`
+	TileMatrixSets []string `yaml:"tileMatrixSets,omitempty"`
+}
+
+// matchAny checks if the value matches one of the glob patterns, or if there are no patterns when empty is true
+func matchAny(patterns []string, value string, empty bool) bool {
+	if len(patterns) == 0 {
+		return empty
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the glob patterns of the policy
+func (p LayerPolicy) validate() error {
+	for _, patterns := range [][]string{p.Clients, p.Allow, p.Deny, p.TileMatrixSets} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *LayerPolicy) permitsLayer(layer string) bool {
+	return p != nil && matchAny(p.Allow, layer, true) && !matchAny(p.Deny, layer, false)
+}
+
+func (p *LayerPolicy) permitsTileMatrixSet(tileMatrixSet string) bool {
+	return p != nil && matchAny(p.TileMatrixSets, tileMatrixSet, true)
+}
+
+// layerPolicy returns the first policy for the client, or nil when no policy applies to the client
+func (c *Config) layerPolicy(client string) *LayerPolicy {
+	for i, p := range c.LayerPolicies {
+		if matchAny(p.Clients, client, true) {
+			return &c.LayerPolicies[i]
+		}
+	}
+	return nil
+}
+
+// checkPolicy checks if the client of the request is permitted the layer and tile matrix set,
+// without policies everything is permitted
+func (c *Config) checkPolicy(r *http.Request, layer string, tileMatrixSet string) Exception {
+	if c == nil || len(c.LayerPolicies) == 0 {
+		return nil
+	}
+	policy := c.layerPolicy(requestClient(r))
+	if !policy.permitsLayer(layer) {
+		return NotPermitted("layer")
+	}
+	if !policy.permitsTileMatrixSet(tileMatrixSet) {
+		return NotPermitted("tilematrixset")
+	}
+	return nil
+}
+
+// requestClient returns the client authenticated for the request, or an empty string
+func requestClient(r *http.Request) string {
+	if info := GetRequestInfo(r); info != nil {
+		return info.Client
+	}
+	return ""
+}
+
+// filterCapabilities removes the layers, tile matrix set links and tile matrix sets the client
+// is not permitted from the capabilities document, with the theme references to the removed
+// layers. The rest of the document is kept as is.
+func (c *Config) filterCapabilities(document []byte, client string) ([]byte, error) {
+	if len(c.LayerPolicies) == 0 {
+		return document, nil
+	}
+	policy := c.layerPolicy(client)
+
+	type element struct {
+		name       string
+		start      int64
+		identifier string
+		links      int
+		keptLinks  int
+	}
+	var stack []*element
+	var removed [][2]int64
+	removedLayers := map[string]bool{}
+	parent := func(depth int) string {
+		if len(stack) > depth {
+			return stack[len(stack)-1-depth].name
+		}
+		return ""
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not filter the capabilities: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, &element{name: t.Name.Local, start: start})
+		case xml.CharData:
+			// the identifier of a layer or tile matrix set, or the tile matrix set of a link
+			if len(stack) >= 2 && (parent(0) == "Identifier" || (parent(0) == "TileMatrixSet" && parent(1) == "TileMatrixSetLink")) {
+				stack[len(stack)-2].identifier += string(bytes.TrimSpace(t))
+			}
+			// the layer referenced by a theme
+			if parent(0) == "LayerRef" {
+				stack[len(stack)-1].identifier += string(bytes.TrimSpace(t))
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("could not filter the capabilities: unexpected end element %s", t.Name.Local)
+			}
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			remove := false
+			switch {
+			case e.name == "Layer" && parent(0) == "Contents":
+				remove = !policy.permitsLayer(e.identifier) || (e.links > 0 && e.keptLinks == 0)
+				removedLayers[e.identifier] = remove
+			case e.name == "LayerRef" && parent(0) == "Theme":
+				remove = !policy.permitsLayer(e.identifier) || removedLayers[e.identifier]
+			case e.name == "TileMatrixSet" && parent(0) == "Contents":
+				remove = !policy.permitsTileMatrixSet(e.identifier)
+			case e.name == "TileMatrixSetLink" && parent(0) == "Layer":
+				layer := stack[len(stack)-1]
+				layer.links++
+				remove = !policy.permitsTileMatrixSet(e.identifier)
+				if !remove {
+					layer.keptLinks++
+				}
+			}
+			if remove {
+				// the links removed from a removed layer go with it
+				for len(removed) > 0 && removed[len(removed)-1][0] >= e.start {
+					removed = removed[:len(removed)-1]
+				}
+				removed = append(removed, [2]int64{e.start, decoder.InputOffset()})
+			}
+		}
+	}
+
+	if len(removed) == 0 {
+		return document, nil
+	}
+	var filtered []byte
+	var offset int64
+	for _, r := range removed {
+		start := trimIndentation(document, r[0])
+		filtered = append(filtered, document[offset:start]...)
+		offset = r[1]
+	}
+	return append(filtered, document[offset:]...), nil
+}
+
+// trimIndentation moves the start of a removed element back over its indentation and line break
+func trimIndentation(document []byte, start int64) int64 {
+	i := start
+	for i > 0 && (document[i-1] == ' ' || document[i-1] == '\t') {
+		i--
+	}
+	if i > 0 && document[i-1] == '\n' {
+		i--
+		if i > 0 && document[i-1] == '\r' {
+			i--
+		}
+		return i
+	}
+	return start
+}
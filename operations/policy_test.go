@@ -0,0 +1,209 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const policyTestCapabilities = `<Capabilities>
+  <Contents>
+    <Layer>
+      <ows:Identifier>brt</ows:Identifier>
+      <TileMatrixSetLink>
+        <TileMatrixSet>EPSG:28992</TileMatrixSet>
+      </TileMatrixSetLink>
+      <TileMatrixSetLink>
+        <TileMatrixSet>EPSG:3857</TileMatrixSet>
+      </TileMatrixSetLink>
+    </Layer>
+    <Layer>
+      <ows:Identifier>brt_private</ows:Identifier>
+      <TileMatrixSetLink>
+        <TileMatrixSet>EPSG:3857</TileMatrixSet>
+      </TileMatrixSetLink>
+    </Layer>
+    <Layer>
+      <ows:Identifier>luchtfoto</ows:Identifier>
+      <TileMatrixSetLink>
+        <TileMatrixSet>EPSG:3857</TileMatrixSet>
+      </TileMatrixSetLink>
+    </Layer>
+    <TileMatrixSet>
+      <ows:Identifier>EPSG:28992</ows:Identifier>
+    </TileMatrixSet>
+    <TileMatrixSet>
+      <ows:Identifier>EPSG:3857</ows:Identifier>
+    </TileMatrixSet>
+  </Contents>
+  <Themes>
+    <Theme>
+      <ows:Identifier>basemaps</ows:Identifier>
+      <LayerRef>brt</LayerRef>
+      <LayerRef>brt_private</LayerRef>
+      <LayerRef>luchtfoto</LayerRef>
+    </Theme>
+  </Themes>
+</Capabilities>`
+
+var policyTestConfig = &Config{LayerPolicies: []LayerPolicy{
+	{Clients: []string{"partner-*"}, Allow: []string{"brt*"}, Deny: []string{"*_private"}, TileMatrixSets: []string{"EPSG:28992"}},
+	{Clients: []string{"internal"}},
+	{Allow: []string{"luchtfoto"}},
+}}
+
+func TestFilterCapabilities(t *testing.T) {
+	result, err := policyTestConfig.filterCapabilities([]byte(policyTestCapabilities), "partner-a")
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	expected := `<Capabilities>
+  <Contents>
+    <Layer>
+      <ows:Identifier>brt</ows:Identifier>
+      <TileMatrixSetLink>
+        <TileMatrixSet>EPSG:28992</TileMatrixSet>
+      </TileMatrixSetLink>
+    </Layer>
+    <TileMatrixSet>
+      <ows:Identifier>EPSG:28992</ows:Identifier>
+    </TileMatrixSet>
+  </Contents>
+  <Themes>
+    <Theme>
+      <ows:Identifier>basemaps</ows:Identifier>
+      <LayerRef>brt</LayerRef>
+    </Theme>
+  </Themes>
+</Capabilities>`
+	if string(result) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, result)
+	}
+
+	if result, _ := policyTestConfig.filterCapabilities([]byte(policyTestCapabilities), "internal"); string(result) != policyTestCapabilities {
+		t.Errorf("Expected the whole document for a client with every layer, got:\n%s", result)
+	}
+
+	result, _ = policyTestConfig.filterCapabilities([]byte(policyTestCapabilities), "")
+	if strings.Contains(string(result), "brt") || !strings.Contains(string(result), "luchtfoto") {
+		t.Errorf("Expected only luchtfoto for an anonymous client, got:\n%s", result)
+	}
+}
+
+func TestFilterCapabilitiesNoPolicy(t *testing.T) {
+	config := &Config{LayerPolicies: []LayerPolicy{{Clients: []string{"internal"}}}}
+	result, err := config.filterCapabilities([]byte(policyTestCapabilities), "other")
+	if err != nil || strings.Contains(string(result), "<Layer>") || strings.Contains(string(result), "<TileMatrixSet>") || strings.Contains(string(result), "<LayerRef>") {
+		t.Errorf("Expected no layers for a client without a policy, got: %s %v", result, err)
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	expected := []struct {
+		client        string
+		layer         string
+		tileMatrixSet string
+		locator       string
+	}{
+		{"partner-a", "brt", "EPSG:28992", ""},
+		{"partner-a", "brt_private", "EPSG:28992", "layer"},
+		{"partner-a", "brt", "EPSG:3857", "tilematrixset"},
+		{"partner-a", "luchtfoto", "EPSG:28992", "layer"},
+		{"internal", "brt_private", "EPSG:3857", ""},
+		{"", "luchtfoto", "EPSG:3857", ""},
+		{"", "brt", "EPSG:28992", "layer"},
+	}
+	for _, e := range expected {
+		r, info := WithRequestInfo(httptest.NewRequest("GET", "/wmts", nil))
+		info.Client = e.client
+		err := policyTestConfig.checkPolicy(r, e.layer, e.tileMatrixSet)
+		if (err == nil) != (len(e.locator) == 0) || (err != nil && (err.Locator() != e.locator || err.Status() != http.StatusForbidden)) {
+			t.Errorf("Expected %q for %s %s %s, got: %v", e.locator, e.client, e.layer, e.tileMatrixSet, err)
+		}
+	}
+}
+
+func TestProcessRequestPolicy(t *testing.T) {
+	config := &Config{Host: "http://localhost", Template: "testCapabilitiesTemplate", LayerPolicies: []LayerPolicy{{Allow: []string{"osm"}}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := WithRequestInfo(httptest.NewRequest("GET", "/wmts?SERVICE=WMTS&REQUEST=GetTile&VERSION=1.0.0&LAYER=plain&STYLE=default&TILEMATRIXSET=GLOBAL_MERCATOR&TILEMATRIX=00&TILECOL=0&TILEROW=0&FORMAT=image/png", nil))
+	if ProcessRequest(config, w, r) || w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `locator="layer"`) {
+		t.Errorf("Expected a 403 exception for a layer that is not permitted, got: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = WithRequestInfo(httptest.NewRequest("GET", "/wmts/plain/GLOBAL_MERCATOR/00/0/0.png", nil))
+	if ProcessRequest(config, w, r) || w.Code != http.StatusForbidden {
+		t.Errorf("Expected a 403 exception for a RESTful request for a layer that is not permitted, got: %d %s", w.Code, w.Body.String())
+	}
+	if !ProcessRequest(config, httptest.NewRecorder(), httptest.NewRequest("GET", "/wmts/osm/GLOBAL_MERCATOR/00/0/0.png", nil)) {
+		t.Errorf("Expected a RESTful request for a permitted layer to be proxied")
+	}
+	for _, extension := range []string{".jpg", ".gif"} {
+		w = httptest.NewRecorder()
+		r, _ = WithRequestInfo(httptest.NewRequest("GET", "/wmts/plain/GLOBAL_MERCATOR/00/0/0"+extension, nil))
+		if ProcessRequest(config, w, r) || w.Code != http.StatusForbidden {
+			t.Errorf("Expected a 403 exception for a RESTful request with an unknown extension %s for a layer that is not permitted, got: %d %s", extension, w.Code, w.Body.String())
+		}
+	}
+
+	for _, path := range []string{"/wmts?SERVICE=WMTS&REQUEST=GetCapabilities", "/wmts/1.0.0/WMTSCapabilities.xml"} {
+		w = httptest.NewRecorder()
+		r, _ = WithRequestInfo(httptest.NewRequest("GET", path, nil))
+		if ProcessRequest(config, w, r) {
+			t.Errorf("Expected the capabilities for %s not to be proxied", path)
+		}
+		if !strings.Contains(w.Body.String(), "<ows:Identifier>osm</ows:Identifier>") || strings.Contains(w.Body.String(), "<ows:Identifier>plain</ows:Identifier>") ||
+			w.Header().Get("Cache-Control") != "private" {
+			t.Errorf("Expected private capabilities with only the osm layer for %s, got: %v %s", path, w.Header(), w.Body.String())
+		}
+	}
+}
+
+func TestProcessRESTfulRequestPolicy(t *testing.T) {
+	config := &Config{Host: "http://localhost", Mode: ModeRESTful, UpstreamCapabilities: true, LayerPolicies: []LayerPolicy{{TileMatrixSets: []string{"EPSG:28992"}}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	if ProcessRESTfulRequest(config, w, httptest.NewRequest("GET", "/wmts/brt/EPSG:3857/04/7/8.png", nil)) || w.Code != http.StatusForbidden {
+		t.Errorf("Expected a 403 exception for a tile matrix set that is not permitted, got: %d %s", w.Code, w.Body.String())
+	}
+	if !ProcessRESTfulRequest(config, httptest.NewRecorder(), httptest.NewRequest("GET", "/wmts/brt/EPSG:28992/04/7/8.png", nil)) {
+		t.Errorf("Expected a permitted tile to be proxied")
+	}
+	w = httptest.NewRecorder()
+	if ProcessRESTfulRequest(config, w, httptest.NewRequest("GET", "/wmts/brt/EPSG:3857/04/7/8.jpg", nil)) || w.Code != http.StatusForbidden {
+		t.Errorf("Expected a 403 exception for an unknown extension in a tile matrix set that is not permitted, got: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateLayerPolicies(t *testing.T) {
+	config := &Config{LayerPolicies: []LayerPolicy{{Allow: []string{"[brt"}}}}
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "layerPolicies[0]") || !strings.Contains(err.Error(), "need a template") {
+		t.Errorf("Expected errors for the pattern and the missing template, got: %v", err)
+	}
+}
+
+func TestAuthenticatorClient(t *testing.T) {
+	var client string
+	handler := NewAuthenticator(testConfig(t, &Config{AuthKeyFile: writeKeyFile(t, "key-a partner-a\nkey-b\n")})).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = requestClient(r)
+	}))
+	expected := map[string]string{"key-a": "partner-a", "key-b": ""}
+	for key, name := range expected {
+		client = "unset"
+		r, _ := WithRequestInfo(httptest.NewRequest("GET", "/wmts?apikey="+key, nil))
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if client != name {
+			t.Errorf("Expected client %q for %s, got: %q", name, key, client)
+		}
+	}
+}
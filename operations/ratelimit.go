@@ -0,0 +1,216 @@
+package operations
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Operation of a rate limit that applies to every request without a limit of its own
+const anyOperation = "*"
+
+// Interval the buckets of the clients that have been idle long enough to be full again are removed
+const rateLimitSweepInterval = time.Minute
+
+var rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wmts_rate_limited_total",
+	Help: "Number of requests refused by the rate limit by operation.",
+}, []string{"operation"})
+
+// RateLimit allows a client Rate requests per second for the operation, with bursts up to Burst requests
+type RateLimit struct {
+	Operation string  `yaml:"operation"`
+	Rate      float64 `yaml:"rate"`
+	Burst     int     `yaml:"burst,omitempty"`
+}
+
+// ParseRateLimit parses a rate limit in the form <operation>=<rate>[:<burst>],
+// without a burst the rate rounded up is used
+func ParseRateLimit(value string) (RateLimit, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return RateLimit{}, fmt.Errorf("rate limit %q must be in the form <operation>=<rate>[:<burst>]", value)
+	}
+	limit := RateLimit{Operation: value[:i]}
+	rate, burst, hasBurst := strings.Cut(value[i+1:], ":")
+
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+		return RateLimit{}, fmt.Errorf("rate limit %q has an invalid rate: %w", value, err)
+	}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil {
+			return RateLimit{}, fmt.Errorf("rate limit %q has an invalid burst: %w", value, err)
+		}
+	}
+	return limit, nil
+}
+
+// burst returns the number of requests a client can do at once
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%s=%g:%d", l.Operation, l.Rate, int(l.burst()))
+}
+
+// validate checks the operation and the rate of the limit
+func (l RateLimit) validate() error {
+	if l.Operation != anyOperation && l.Operation != OperationGetTile && l.Operation != OperationGetFeatureInfo && l.Operation != OperationGetCapabilities {
+		return fmt.Errorf("unknown operation %q, expected %s, %s, %s or %s", l.Operation, OperationGetTile, OperationGetFeatureInfo, OperationGetCapabilities, anyOperation)
+	}
+	if l.Rate <= 0 || l.Burst < 0 {
+		return fmt.Errorf("%s needs a positive rate and burst", l.Operation)
+	}
+	return nil
+}
+
+// rateLimit returns the limit for the operation, the limit for any operation or false when there is none
+func (c *Config) rateLimit(operation string) (RateLimit, bool) {
+	var fallback *RateLimit
+	for i, l := range c.RateLimits {
+		if l.Operation == operation && len(operation) > 0 {
+			return l, true
+		}
+		if l.Operation == anyOperation && fallback == nil {
+			fallback = &c.RateLimits[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return RateLimit{}, false
+}
+
+// RateLimiter limits the requests of every client with a token bucket per operation. A client
+// is identified by the name of its API key or token when authenticated, otherwise by its IP address.
+type RateLimiter struct {
+	config func() *Config
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket holds the requests a client can still do, it is refilled at the rate of the limit
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Duration
+}
+
+// NewRateLimiter returns the rate limiter for the config in use, config is called on every request
+func NewRateLimiter(config func() *Config) *RateLimiter {
+	return &RateLimiter{config: config, buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+}
+
+// Handler refuses the requests over the limit with a 429 exception and a Retry-After header
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := l.config()
+		operation := config.requestOperation(r)
+		limit, ok := config.rateLimit(operation)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := limit.Operation + "\n" + config.rateLimitClient(r)
+		if allowed, retryAfter := l.allow(key, limit, time.Now()); !allowed {
+			if len(operation) > 0 {
+				setOperation(r, operation)
+			}
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			rateLimitedTotal.WithLabelValues(valueOrDefault(operation, operationPassthrough)).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			SendError(WMTSException{ErrorMessage: fmt.Sprintf("Rate limit exceeded, retry after %d seconds", seconds),
+				ErrorCode: "NoApplicableCode", StatusCode: http.StatusTooManyRequests}, w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow takes a token from the bucket of the key, when the bucket is empty it returns
+// the time until the next token is available
+func (l *RateLimiter) allow(key string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	burst := limit.burst()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	b.full = time.Duration(burst / limit.Rate * float64(time.Second))
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets that are full again, they are the same as a new bucket
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= b.full {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimitClient identifies the client by the name set by the authentication, or else by its
+// IP address. Only the proxies in front of the service are trusted to add X-Forwarded-For
+// addresses, the client can put any addresses before them.
+func (c *Config) rateLimitClient(r *http.Request) string {
+	if client := requestClient(r); len(client) > 0 {
+		return "client:" + client
+	}
+	return "ip:" + forwardedIP(r, c.TrustedProxies)
+}
+
+// requestOperation returns the WMTS operation of the request before it is processed,
+// or an empty string when the request is passed through
+func (c *Config) requestOperation(r *http.Request) string {
+	if c.Mode == ModeRESTful {
+		if strings.HasSuffix(r.URL.Path, restfulCapabilitiesPath) {
+			return OperationGetCapabilities
+		}
+		if _, query, ok := c.matchRESTfulPath(r.URL.Path); ok {
+			return query.Get("REQUEST")
+		}
+		return ""
+	}
+
+	for key, values := range r.URL.Query() {
+		if !strings.EqualFold(key, "request") || len(values) == 0 {
+			continue
+		}
+		for _, operation := range []string{OperationGetTile, OperationGetFeatureInfo, OperationGetCapabilities} {
+			if strings.EqualFold(values[0], operation) {
+				return operation
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	expected := map[string]RateLimit{
+		"GetTile=100:200":    {Operation: "GetTile", Rate: 100, Burst: 200},
+		"GetFeatureInfo=0.5": {Operation: "GetFeatureInfo", Rate: 0.5},
+	}
+	for value, limit := range expected {
+		if result, err := ParseRateLimit(value); err != nil || result != limit {
+			t.Errorf("Expected %+v for %s, got: %+v %v", limit, value, result, err)
+		}
+	}
+
+	for _, value := range []string{"GetTile", "GetTile=", "=10", "GetTile=fast", "GetTile=10:many"} {
+		if _, err := ParseRateLimit(value); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	handler := NewRateLimiter(testConfig(t, &Config{RateLimits: []RateLimit{{Operation: OperationGetTile, Rate: 1, Burst: 2}}})).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(query string, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/wmts?service=WMTS&version=1.0.0&"+query, nil)
+		r.RemoteAddr = ip + ":1234"
+		// an address of the client's choice is ignored without trusted proxies
+		r.Header.Set("X-Forwarded-For", "203.0.113.1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i, expected := range []int{200, 200, 429} {
+		if w := request("request=GetTile", "198.51.100.1"); w.Code != expected {
+			t.Errorf("Expected %d for request %d, got: %d", expected, i, w.Code)
+		}
+	}
+	w := request("REQUEST=gettile", "198.51.100.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || !strings.Contains(w.Body.String(), "ows:ExceptionReport") {
+		t.Errorf("Expected a 429 exception report with Retry-After, got: %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	if w := request("request=GetTile", "198.51.100.2"); w.Code != http.StatusOK {
+		t.Errorf("Expected another client not to be limited, got: %d", w.Code)
+	}
+	if w := request("request=GetCapabilities", "198.51.100.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected an operation without a limit not to be limited, got: %d", w.Code)
+	}
+}
+
+func TestRateLimiterClient(t *testing.T) {
+	handler := NewRateLimiter(testConfig(t, &Config{RateLimits: []RateLimit{{Operation: anyOperation, Rate: 1}}})).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	expected := []struct {
+		client string
+		ip     string
+		status int
+	}{
+		{"partner-a", "198.51.100.1", 200},
+		{"partner-a", "198.51.100.2", 429},
+		{"partner-b", "198.51.100.1", 200},
+		{"", "198.51.100.1", 200},
+		{"", "198.51.100.1", 429},
+	}
+	for _, e := range expected {
+		r, info := WithRequestInfo(httptest.NewRequest("GET", "/wmts", nil))
+		info.Client = e.client
+		r.RemoteAddr = e.ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != e.status {
+			t.Errorf("Expected %d for client %q from %s, got: %d", e.status, e.client, e.ip, w.Code)
+		}
+	}
+}
+
+func TestForwardedIP(t *testing.T) {
+	expected := map[int]string{0: "192.0.2.10", 1: "198.51.100.7", 2: "203.0.113.1", 5: "203.0.113.1"}
+	for trustedProxies, ip := range expected {
+		r := httptest.NewRequest("GET", "/wmts", nil)
+		r.RemoteAddr = "192.0.2.10:4321"
+		r.Header.Add("X-Forwarded-For", "203.0.113.1")
+		r.Header.Add("X-Forwarded-For", " , 198.51.100.7")
+		if result := forwardedIP(r, trustedProxies); result != ip {
+			t.Errorf("Expected %s behind %d proxies, got: %s", ip, trustedProxies, result)
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := NewRateLimiter(nil)
+	limit := RateLimit{Operation: OperationGetTile, Rate: 10, Burst: 1}
+	now := time.Now()
+
+	if ok, _ := limiter.allow("client", limit, now); !ok {
+		t.Errorf("Expected the first request to be allowed")
+	}
+	if ok, retryAfter := limiter.allow("client", limit, now.Add(50*time.Millisecond)); ok || retryAfter != 50*time.Millisecond {
+		t.Errorf("Expected to retry after 50ms, got: %t %s", ok, retryAfter)
+	}
+	if ok, _ := limiter.allow("client", limit, now.Add(100*time.Millisecond)); !ok {
+		t.Errorf("Expected a request to be allowed after the refill")
+	}
+
+	limiter.allow("client", limit, now.Add(2*rateLimitSweepInterval))
+	limiter.allow("other", limit, now.Add(3*rateLimitSweepInterval))
+	if _, ok := limiter.buckets["client"]; ok {
+		t.Errorf("Expected the full bucket of an idle client to be removed")
+	}
+}
+
+func TestRequestOperationRESTful(t *testing.T) {
+	config := &Config{Mode: ModeRESTful}
+	expected := map[string]string{
+		"/wmts/1.0.0/WMTSCapabilities.xml":                    OperationGetCapabilities,
+		"/wmts/brtachtergrondkaart/EPSG:28992/04/7/8.png":     OperationGetTile,
+		"/wmts/brtachtergrondkaart/EPSG:28992/04/7/8/1/2.txt": OperationGetFeatureInfo,
+		"/favicon.ico": "",
+	}
+	for path, operation := range expected {
+		if result := config.requestOperation(httptest.NewRequest("GET", path, nil)); result != operation {
+			t.Errorf("Expected %q for %s, got: %q", operation, path, result)
+		}
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	config := &Config{RateLimits: []RateLimit{{Operation: "GetMap", Rate: 1}, {Operation: OperationGetTile}}}
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "rateLimits[0]") || !strings.Contains(err.Error(), "rateLimits[1]") {
+		t.Errorf("Expected errors for both rate limits, got: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package operations
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Readiness checks are done at most once per interval, the result is cached in between
+const (
+	defaultReadinessInterval = 5 * time.Second
+	readinessProbeTimeout    = 2 * time.Second
+)
+
+// Statuses of the readiness check and its components
+const (
+	StatusOK   = "OK"
+	StatusFail = "FAIL"
+)
+
+// ComponentStatus is the readiness of one component, with the reason when it isn't ready
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessStatus is the readiness of the application and of each of its components
+type ReadinessStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Readiness checks that the upstreams are reachable and the capabilities template or the
+// upstream capabilities are loaded.
+// The upstreams are probed at most once per interval, concurrent checks wait for the running probe.
+type Readiness struct {
+	config   func() *Config
+	client   *http.Client
+	interval time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	status  ReadinessStatus
+}
+
+// NewReadiness returns the readiness check of the config in use, config is called on every check
+func NewReadiness(config func() *Config) *Readiness {
+	return &Readiness{
+		config:   config,
+		client:   &http.Client{Timeout: readinessProbeTimeout},
+		interval: defaultReadinessInterval,
+	}
+}
+
+// Check returns the readiness status, probing the upstreams when the cached status is too old
+func (rd *Readiness) Check() ReadinessStatus {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if !rd.checked.IsZero() && time.Since(rd.checked) < rd.interval {
+		return rd.status
+	}
+
+	config := rd.config()
+	components := map[string]ComponentStatus{}
+	if len(config.Template) > 0 {
+		components["capabilities"] = config.templateStatus()
+	} else if config.UpstreamCapabilities && config.upstreamCapabilities != nil {
+		components["capabilities"] = ComponentStatus{Status: StatusOK}
+		if err := config.upstreamCapabilities.failed(); err != nil {
+			components["capabilities"] = ComponentStatus{Status: StatusFail, Error: err.Error()}
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, origin := range config.origins() {
+		wg.Add(1)
+		go func(origin *url.URL) {
+			defer wg.Done()
+			status := rd.probe(origin)
+			mu.Lock()
+			components["upstream "+redactURL(origin.String())] = status
+			mu.Unlock()
+		}(origin)
+	}
+	wg.Wait()
+
+	status := ReadinessStatus{Status: StatusOK, Components: components}
+	for _, component := range components {
+		if component.Status != StatusOK {
+			status.Status = StatusFail
+		}
+	}
+	rd.status, rd.checked = status, time.Now()
+	return status
+}
+
+// templateStatus checks the capabilities template is loaded and its file can still be read,
+// so a template that disappeared is noticed before the next reload
+func (c *Config) templateStatus() ComponentStatus {
+	if c.capabilitiesTemplate == nil {
+		return ComponentStatus{Status: StatusFail, Error: "the capabilities template " + c.Template + " is not loaded"}
+	}
+	f, err := os.Open(c.Template)
+	if err != nil {
+		return ComponentStatus{Status: StatusFail, Error: err.Error()}
+	}
+	f.Close()
+	return ComponentStatus{Status: StatusOK}
+}
+
+// probe requests the upstream, any response below 500 means it is reachable
+func (rd *Readiness) probe(origin *url.URL) ComponentStatus {
+	resp, err := rd.client.Get(origin.String())
+	if err != nil {
+		return ComponentStatus{Status: StatusFail, Error: err.Error()}
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return ComponentStatus{Status: StatusFail, Error: fmt.Sprintf("responded with %d", resp.StatusCode)}
+	}
+	return ComponentStatus{Status: StatusOK}
+}
+
+// ServeHTTP writes the readiness status as JSON, with a 503 when not ready
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := rd.Check()
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// origins returns the distinct origins of the default host and the upstreams
+func (c *Config) origins() []*url.URL {
+	var origins []*url.URL
+	seen := map[string]bool{}
+	add := func(origin *url.URL) {
+		if origin != nil && !seen[origin.String()] {
+			seen[origin.String()] = true
+			origins = append(origins, origin)
+		}
+	}
+	add(c.origin)
+	for _, u := range c.Upstreams {
+		add(u.origin)
+	}
+	return origins
+}
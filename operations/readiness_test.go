@@ -0,0 +1,131 @@
+package operations
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	healthy := &countingUpstream{status: 200}
+	broken := &countingUpstream{status: 502}
+	healthyServer, brokenServer := httptest.NewServer(healthy), httptest.NewServer(broken)
+	defer healthyServer.Close()
+	defer brokenServer.Close()
+
+	config := &Config{Host: healthyServer.URL, Template: "testCapabilitiesTemplate", Upstreams: []Upstream{{Layer: "brt", Host: healthyServer.URL}, {Layer: "luchtfoto", Host: brokenServer.URL}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	NewReadiness(func() *Config { return config }).ServeHTTP(w, httptest.NewRequest("GET", "/health/ready", nil))
+
+	var status ReadinessStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Expected JSON, got: %s %s", w.Body.String(), err)
+	}
+	if w.Code != http.StatusServiceUnavailable || status.Status != StatusFail || len(status.Components) != 3 {
+		t.Errorf("Expected not to be ready with 3 components, got: %d %+v", w.Code, status)
+	}
+	expected := map[string]string{"capabilities": StatusOK, "upstream " + healthyServer.URL: StatusOK, "upstream " + brokenServer.URL: StatusFail}
+	for component, s := range expected {
+		if status.Components[component].Status != s {
+			t.Errorf("Expected %s for %s, got: %+v", s, component, status.Components[component])
+		}
+	}
+	if healthy.requests != 1 {
+		t.Errorf("Expected the shared upstream to be probed once, got: %d", healthy.requests)
+	}
+}
+
+func TestReadinessCached(t *testing.T) {
+	upstream := &countingUpstream{status: 200}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	config := &Config{Host: server.URL}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	readiness := NewReadiness(func() *Config { return config })
+	for i := 0; i < 3; i++ {
+		if status := readiness.Check(); status.Status != StatusOK {
+			t.Errorf("Expected to be ready, got: %+v", status)
+		}
+	}
+	if upstream.requests != 1 {
+		t.Errorf("Expected the upstream to be probed once within the interval, got: %d", upstream.requests)
+	}
+
+	readiness.interval = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	readiness.Check()
+	if upstream.requests != 2 {
+		t.Errorf("Expected the upstream to be probed again after the interval, got: %d", upstream.requests)
+	}
+}
+
+func TestReadinessTemplateNotLoaded(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate"}
+	status := NewReadiness(func() *Config { return config }).Check()
+	if status.Status != StatusFail || status.Components["capabilities"].Status != StatusFail {
+		t.Errorf("Expected not to be ready without a loaded template, got: %+v", status)
+	}
+}
+
+func TestReadinessTemplateRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capabilities.xml")
+	content, _ := os.ReadFile("testCapabilitiesTemplate")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Template: path}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if status := config.templateStatus(); status.Status != StatusOK {
+		t.Errorf("Expected the template to be ready, got: %+v", status)
+	}
+	os.Remove(path)
+	if status := config.templateStatus(); status.Status != StatusFail {
+		t.Errorf("Expected not to be ready without the template file, got: %+v", status)
+	}
+}
+
+func TestReadinessUpstreamCapabilities(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/wmts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(upstreamRESTfulCapabilities))
+	}))
+	defer upstream.Close()
+	config := &Config{Host: upstream.URL, UpstreamCapabilities: true}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	check := func() ComponentStatus {
+		readiness := NewReadiness(func() *Config { return config })
+		return readiness.Check().Components["capabilities"]
+	}
+	if status := check(); status.Status != StatusOK {
+		t.Errorf("Expected to be ready before any capabilities are fetched, got: %+v", status)
+	}
+	config.upstreamCapabilities.get(config.origin, "/other")
+	if status := check(); status.Status != StatusFail || !strings.Contains(status.Error, "/other") {
+		t.Errorf("Expected not to be ready without any capabilities, got: %+v", status)
+	}
+	config.upstreamCapabilities.get(config.origin, "/wmts")
+	if status := check(); status.Status != StatusOK {
+		t.Errorf("Expected to be ready with loaded capabilities, got: %+v", status)
+	}
+}
@@ -0,0 +1,126 @@
+package operations
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Default interval the config file and the capabilities template are checked for changes
+const defaultReloadInterval = 10 * time.Second
+
+var reloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wmts_config_reloads_total",
+	Help: "Number of config and capabilities template reloads by result.",
+}, []string{"result"})
+
+// Reloader holds the config in use, a reload replaces it atomically with a newly
+// loaded config. When the new config fails to load it is logged and the last good
+// config stays in use.
+type Reloader struct {
+	load    func() (*Config, error)
+	current atomic.Pointer[Config]
+	mu      sync.Mutex
+}
+
+// NewReloader returns a reloader starting with the initialised config,
+// load is used to load and initialise the config on every reload
+func NewReloader(config *Config, load func() (*Config, error)) *Reloader {
+	r := &Reloader{load: load}
+	r.current.Store(config)
+	return r
+}
+
+// Config returns the config in use
+func (r *Reloader) Config() *Config {
+	return r.current.Load()
+}
+
+// Reload loads the config and, when successful, puts it in use
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := r.load()
+	if err != nil {
+		reloadsTotal.WithLabelValues("failure").Inc()
+		log.Printf("reload failed, the last good config stays in use: %v", err)
+		return err
+	}
+	r.current.Store(config)
+	reloadsTotal.WithLabelValues("success").Inc()
+	log.Println("config reloaded")
+	return nil
+}
+
+// Watch reloads the config whenever one of the files, the capabilities template or the API key
+// file of the config in use changes, the files are checked every interval until the context is
+// done. Without an interval the files are not watched.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, files ...string) {
+	if interval <= 0 {
+		return
+	}
+	watchFiles(ctx, interval, func() []string {
+		watched := files[:len(files):len(files)]
+		config := r.Config()
+		for _, file := range []string{config.Template, config.AuthKeyFile} {
+			if len(file) > 0 {
+				watched = append(watched, file)
+			}
+		}
+		return watched
+	}, func() { r.Reload() })
+}
+
+// watchFiles calls changed whenever one of the watched files changes,
+// the files are checked every interval until the context is done
+func watchFiles(ctx context.Context, interval time.Duration, watched func() []string, changed func()) {
+	states := map[string]fileState{}
+	for _, file := range watched() {
+		states[file] = statFile(file)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		change := false
+		for _, file := range watched() {
+			state := statFile(file)
+			if previous, ok := states[file]; !ok || state != previous {
+				states[file] = state
+				change = change || ok
+			}
+		}
+		if change {
+			changed()
+		}
+	}
+}
+
+// fileState is used to detect changes of a file, a Kubernetes ConfigMap is
+// updated by replacing a symlink so the target of the file is checked
+type fileState struct {
+	modTime time.Time
+	size    int64
+	missing bool
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{missing: true}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}
+}
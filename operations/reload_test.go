@@ -0,0 +1,76 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	first, second := &Config{Host: "http://first"}, &Config{Host: "http://second"}
+	var loadErr error
+	reloader := NewReloader(first, func() (*Config, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return second, nil
+	})
+
+	if err := reloader.Reload(); err != nil || reloader.Config() != second {
+		t.Errorf("Expected the reloaded config, got: %v %+v", err, reloader.Config())
+	}
+
+	loadErr = errors.New("broken template")
+	if err := reloader.Reload(); err == nil || reloader.Config() != second {
+		t.Errorf("Expected the last good config to stay in use, got: %v %+v", err, reloader.Config())
+	}
+}
+
+func TestReloadBrokenTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capabilities.xml")
+	if err := os.WriteFile(path, []byte("{{ .Host"), 0o600); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	config := &Config{Host: "http://default", Template: path}
+	if err := config.Init(); err == nil {
+		t.Errorf("Expected an error for the broken template")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := writeConfigFile(t, "host: http://first\n")
+	load := func() (*Config, error) {
+		config := NewConfig()
+		if err := LoadConfigFile(path, config); err != nil {
+			return nil, err
+		}
+		return config, config.Init()
+	}
+	config, err := load()
+	if err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	reloader := NewReloader(config, load)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond, path)
+
+	// give the watcher time to record the file before changing it
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("host: http://second:8080\n"), 0o600); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for reloader.Config().Host != "http://second:8080" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the changed config file to be reloaded, got: %s", reloader.Config().Host)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
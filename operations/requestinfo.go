@@ -0,0 +1,84 @@
+package operations
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WMTS operations recorded in the RequestInfo
+const (
+	OperationGetCapabilities = "GetCapabilities"
+	OperationGetTile         = "GetTile"
+	OperationGetFeatureInfo  = "GetFeatureInfo"
+)
+
+type requestInfoKey struct{}
+
+// RequestInfo holds what is learned about a request while processing it,
+// it is shared with the proxy through the context of the request
+type RequestInfo struct {
+	Operation           string
+	Layer               string
+	TileMatrixSet       string
+	TileMatrix          string
+	TileCol             string
+	TileRow             string
+	UpstreamDuration    time.Duration
+	Upstream            *url.URL
+	CredentialParameter string
+	Client              string
+}
+
+// WithRequestInfo returns a shallow copy of the request with an empty RequestInfo in its context
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// GetRequestInfo returns the RequestInfo of the request, or nil when there is none
+func GetRequestInfo(r *http.Request) *RequestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// setOperation records the WMTS operation, when the request has a RequestInfo
+func setOperation(r *http.Request, operation string) {
+	if info := GetRequestInfo(r); info != nil {
+		info.Operation = operation
+	}
+}
+
+// setTile records the requested layer, tile matrix set and tile, when the request has a RequestInfo
+func setTile(r *http.Request, layer string, tileMatrixSet string, tileMatrix string, tileCol string, tileRow string) {
+	if info := GetRequestInfo(r); info != nil {
+		info.Layer = layer
+		info.TileMatrixSet = tileMatrixSet
+		info.TileMatrix = tileMatrix
+		info.TileCol = tileCol
+		info.TileRow = tileRow
+	}
+}
+
+// forwardedIP returns the address of the client behind the given number of trusted proxies,
+// this is the address the outermost trusted proxy added to the X-Forwarded-For header
+func forwardedIP(r *http.Request, trustedProxies int) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	hops := []string{host}
+	values := r.Header.Values("X-Forwarded-For")
+	for i := len(values) - 1; i >= 0 && len(hops) <= trustedProxies; i-- {
+		addresses := strings.Split(values[i], ",")
+		for j := len(addresses) - 1; j >= 0 && len(hops) <= trustedProxies; j-- {
+			if address := strings.TrimSpace(addresses[j]); len(address) > 0 {
+				hops = append(hops, address)
+			}
+		}
+	}
+	return hops[len(hops)-1]
+}
@@ -0,0 +1,222 @@
+package operations
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Modes of operation
+const (
+	// ModeKVP rewrites WMTS KVP requests to RESTful requests
+	ModeKVP = "kvp"
+	// ModeRESTful rewrites WMTS RESTful requests to KVP requests
+	ModeRESTful = "restful"
+)
+
+// RESTful path of the WMTS Capabilities document
+const restfulCapabilitiesPath = "/1.0.0/WMTSCapabilities.xml"
+
+// restfulTemplates returns the path templates a RESTful request is matched against,
+// first the ResourceURL templates followed by the GetFeatureInfo and GetTile template
+func (c *Config) restfulTemplates() []resourceTemplate {
+	var templates []resourceTemplate
+	if c != nil {
+		templates = c.resourceTemplates.sorted()
+	}
+	return append(templates,
+		resourceTemplate{resourceType: resourceTypeFeatureInfo, template: c.getFeatureInfoTemplate("", "")},
+		resourceTemplate{resourceType: resourceTypeTile, template: c.getTileTemplate("", "")})
+}
+
+// restfulValuesToQuery builds the KVP query from the values matched by the template,
+// it returns false when the values are not enough for a valid request
+func (c *Config) restfulValuesToQuery(rt resourceTemplate, values map[string]string) (url.Values, bool) {
+	layer := valueOrDefault(rt.layer, values["layer"])
+	for _, key := range []string{"tilematrixset", "tilematrix", "tilecol", "tilerow"} {
+		if len(values[key]) == 0 {
+			return nil, false
+		}
+	}
+	if len(layer) == 0 {
+		return nil, false
+	}
+
+	query := url.Values{
+		"SERVICE":       {"WMTS"},
+		"VERSION":       {"1.0.0"},
+		"LAYER":         {layer},
+		"STYLE":         {c.getStyle(url.Values{"style": {values["style"]}})},
+		"TILEMATRIXSET": {values["tilematrixset"]},
+		"TILEMATRIX":    {values["tilematrix"]},
+		"TILECOL":       {values["tilecol"]},
+		"TILEROW":       {values["tilerow"]},
+	}
+
+	for _, d := range c.getDimensions(layer) {
+		if v, ok := values[strings.ToLower(d.Identifier)]; ok {
+			query[strings.ToUpper(d.Identifier)] = []string{v}
+		}
+	}
+
+	format := rt.format
+	switch rt.resourceType {
+	case resourceTypeFeatureInfo:
+		if len(format) == 0 {
+			infoFormat, err := parseInfoFormat(values["fileextension"])
+			if err != nil {
+				return nil, false
+			}
+			format = infoFormat
+		}
+		query["REQUEST"] = []string{OperationGetFeatureInfo}
+		query["INFOFORMAT"] = []string{format}
+		query["I"] = []string{values["i"]}
+		query["J"] = []string{values["j"]}
+	default:
+		if len(format) == 0 {
+			tileFormat, err := c.getFormat(values["fileextension"])
+			if err != nil {
+				return nil, false
+			}
+			format = tileFormat
+		}
+		query["REQUEST"] = []string{OperationGetTile}
+		query["FORMAT"] = []string{format}
+	}
+	return query, true
+}
+
+// WMTS keys of a KVP request, they are taken from the RESTful path and not from the original query
+var kvpKeys = []string{"service", "request", "version", "layer", "style", "tilematrixset", "tilematrix", "tilecol", "tilerow", "format", "infoformat", "i", "j"}
+
+// setKVPQuery replaces the path of the request and puts the KVP query in front of the original query.
+// The WMTS keys and the dimensions of the layer are removed from the original query, a second value
+// for a key would leave it up to the backend which one is used.
+func (c *Config) setKVPQuery(r *http.Request, path string, query url.Values) {
+	keys := kvpKeys
+	for _, d := range c.getDimensions(query.Get("LAYER")) {
+		keys = append(keys[:len(keys):len(keys)], d.Identifier)
+	}
+	original := r.URL.RawQuery
+	for _, key := range keys {
+		original, _, _ = removeQueryParameter(original, key)
+	}
+
+	rawQuery := query.Encode()
+	if len(original) > 0 {
+		rawQuery = rawQuery + "&" + original
+	}
+	r.URL.Path = path
+	r.URL.RawPath = ""
+	r.URL.RawQuery = rawQuery
+}
+
+// ProcessRESTfulRequest rewrites a RESTful request as KVP request so it can be proxied
+// to a KVP only backend. A request that doesn't match one of the path templates is
+// proxied unchanged.
+func ProcessRESTfulRequest(config *Config, w http.ResponseWriter, r *http.Request) bool {
+	if !processRESTfulRequest(config, w, r) {
+		return false
+	}
+	config.setUpstream(r)
+	return true
+}
+
+func processRESTfulRequest(config *Config, w http.ResponseWriter, r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, restfulCapabilitiesPath) {
+		path := strings.TrimSuffix(r.URL.Path, restfulCapabilitiesPath)
+		setOperation(r, OperationGetCapabilities)
+		if len(config.Template) > 0 || config.UpstreamCapabilities {
+			r.URL.Path = path
+			err := ProcessGetCapabilitiesRequest(config, w, r)
+			if err != nil {
+				SendError(err, w, r)
+			}
+			return false
+		}
+		config.setKVPQuery(r, path, url.Values{"SERVICE": {"WMTS"}, "REQUEST": {"GetCapabilities"}, "VERSION": {"1.0.0"}})
+		return true
+	}
+
+	if path, query, ok := config.matchRESTfulPath(r.URL.Path); ok {
+		config.setKVPQuery(r, path, query)
+		setOperation(r, query.Get("REQUEST"))
+		setTile(r, query.Get("LAYER"), query.Get("TILEMATRIXSET"), query.Get("TILEMATRIX"), query.Get("TILECOL"), query.Get("TILEROW"))
+		if err := config.checkPolicy(r, query.Get("LAYER"), query.Get("TILEMATRIXSET")); err != nil {
+			SendError(err, w, r)
+			return false
+		}
+		return true
+	}
+	// a request proxied unchanged, like one with an unknown extension, has to be permitted as well
+	return config.passRESTfulRequest(w, r)
+}
+
+// passRESTfulRequest records the tile of a RESTful request that is passed through unchanged, so
+// it goes to the upstream of its layer, and checks the policy for it. A request that is not
+// permitted is answered with an exception and false is returned. With policies the RESTful
+// capabilities are answered with the filtered capabilities instead of the upstream document.
+func (c *Config) passRESTfulRequest(w http.ResponseWriter, r *http.Request) bool {
+	if c == nil {
+		return true
+	}
+	if len(c.LayerPolicies) > 0 && strings.HasSuffix(r.URL.Path, restfulCapabilitiesPath) {
+		setOperation(r, OperationGetCapabilities)
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, restfulCapabilitiesPath)
+		if err := ProcessGetCapabilitiesRequest(c, w, r); err != nil {
+			SendError(err, w, r)
+		}
+		return false
+	}
+	if query, ok := c.matchRESTfulTile(r.URL.Path); ok {
+		setTile(r, query.Get("LAYER"), query.Get("TILEMATRIXSET"), query.Get("TILEMATRIX"), query.Get("TILECOL"), query.Get("TILEROW"))
+		if err := c.checkPolicy(r, query.Get("LAYER"), query.Get("TILEMATRIXSET")); err != nil {
+			SendError(err, w, r)
+			return false
+		}
+	}
+	return true
+}
+
+// matchRESTfulPath matches the path against the RESTful templates, it returns the part
+// of the path before the template and the KVP query of the first matching template
+func (c *Config) matchRESTfulPath(urlPath string) (string, url.Values, bool) {
+	for _, rt := range c.restfulTemplates() {
+		path, values, ok := rt.template.match(urlPath)
+		if !ok {
+			continue
+		}
+		if query, ok := c.restfulValuesToQuery(rt, values); ok {
+			return path, query, true
+		}
+	}
+	return "", nil, false
+}
+
+// matchRESTfulTile matches the path against the RESTful templates like matchRESTfulPath, but a
+// path that doesn't make a valid request, like one with an unknown extension, still gives the
+// tile of the first matching template. Only the layer and tile parameters are returned.
+func (c *Config) matchRESTfulTile(urlPath string) (url.Values, bool) {
+	if _, query, ok := c.matchRESTfulPath(urlPath); ok {
+		return query, true
+	}
+	for _, rt := range c.restfulTemplates() {
+		_, values, ok := rt.template.match(urlPath)
+		if !ok {
+			continue
+		}
+		layer := valueOrDefault(rt.layer, values["layer"])
+		if len(layer) == 0 || len(values["tilematrixset"]) == 0 {
+			continue
+		}
+		return url.Values{
+			"LAYER":         {layer},
+			"TILEMATRIXSET": {values["tilematrixset"]},
+			"TILEMATRIX":    {values["tilematrix"]},
+			"TILECOL":       {values["tilecol"]},
+			"TILEROW":       {values["tilerow"]},
+		}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,106 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProcessRESTfulRequest(t *testing.T) {
+	config := &Config{Mode: ModeRESTful}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"/tiles/service/wmts/brtachtergrondkaart/EPSG:28992/04/7/8.png":        "/tiles/service/wmts?FORMAT=image%2Fpng&LAYER=brtachtergrondkaart&REQUEST=GetTile&SERVICE=WMTS&STYLE=default&TILECOL=7&TILEMATRIX=04&TILEMATRIXSET=EPSG%3A28992&TILEROW=8&VERSION=1.0.0",
+		"/tiles/service/wmts/brtachtergrondkaart/EPSG:28992/04/7/8/10/20.json": "/tiles/service/wmts?I=10&INFOFORMAT=application%2Fjson&J=20&LAYER=brtachtergrondkaart&REQUEST=GetFeatureInfo&SERVICE=WMTS&STYLE=default&TILECOL=7&TILEMATRIX=04&TILEMATRIXSET=EPSG%3A28992&TILEROW=8&VERSION=1.0.0",
+		"/tiles/service/wmts/1.0.0/WMTSCapabilities.xml":                       "/tiles/service/wmts?REQUEST=GetCapabilities&SERVICE=WMTS&VERSION=1.0.0",
+		"/tiles/service/wmts/brtachtergrondkaart/EPSG:28992/04/7/8.css":        "/tiles/service/wmts/brtachtergrondkaart/EPSG:28992/04/7/8.css",
+		"/health": "/health",
+	}
+
+	for path, result := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: path}, Header: http.Header{}}
+		if !ProcessRESTfulRequest(config, httptest.NewRecorder(), mockRequest) {
+			t.Errorf("Expected request %s to be proxied", path)
+		}
+		if mockRequest.URL.String() != result {
+			t.Errorf("Expected %s but was not, got: %s", result, mockRequest.URL.String())
+		}
+	}
+}
+
+func TestProcessRESTfulRequestResourceURL(t *testing.T) {
+	config := &Config{Mode: ModeRESTful, Template: "testCapabilitiesTemplate"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts/weather/2024-01-02/GLOBAL_MERCATOR/01/1/0.png", RawQuery: "testkey=testvalue"}, Header: http.Header{}}
+	if !ProcessRESTfulRequest(config, httptest.NewRecorder(), mockRequest) {
+		t.Fatalf("Expected request to be proxied")
+	}
+
+	expected := "/wmts?FORMAT=image%2Fpng&LAYER=weather&REQUEST=GetTile&SERVICE=WMTS&STYLE=default&TILECOL=1&TILEMATRIX=01&TILEMATRIXSET=GLOBAL_MERCATOR&TILEROW=0&TIME=2024-01-02&VERSION=1.0.0&testkey=testvalue"
+	if mockRequest.URL.String() != expected {
+		t.Errorf("Expected %s but was not, got: %s", expected, mockRequest.URL.String())
+	}
+}
+
+func TestProcessRESTfulRequestOriginalQuery(t *testing.T) {
+	config := &Config{Mode: ModeRESTful, Template: "testCapabilitiesTemplate"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts/weather/2024-01-02/GLOBAL_MERCATOR/01/1/0.png",
+		RawQuery: "layer=secret&TILEMATRIXSET=x&%4Cayer=secret&Time=2000-01-01&Request=GetCapabilities&testkey=testvalue"}, Header: http.Header{}}
+	if !ProcessRESTfulRequest(config, httptest.NewRecorder(), mockRequest) {
+		t.Fatalf("Expected request to be proxied")
+	}
+
+	expected := "/wmts?FORMAT=image%2Fpng&LAYER=weather&REQUEST=GetTile&SERVICE=WMTS&STYLE=default&TILECOL=1&TILEMATRIX=01&TILEMATRIXSET=GLOBAL_MERCATOR&TILEROW=0&TIME=2024-01-02&VERSION=1.0.0&testkey=testvalue"
+	if mockRequest.URL.String() != expected {
+		t.Errorf("Expected the WMTS keys to be removed from the original query %s but was not, got: %s", expected, mockRequest.URL.String())
+	}
+}
+
+func TestProcessRESTfulRequestCapabilitiesTemplate(t *testing.T) {
+	config := &Config{Mode: ModeRESTful, Template: "testTemplate"}
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts/1.0.0/WMTSCapabilities.xml"}, Header: http.Header{}}
+	w := httptest.NewRecorder()
+
+	if ProcessRESTfulRequest(config, w, mockRequest) {
+		t.Fatalf("Expected the capabilities not to be proxied")
+	}
+	expected := "http://example.com/wmts"
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("Expected %s but was not, got: %s", expected, w.Body.String())
+	}
+}
+
+func TestGetFormat(t *testing.T) {
+	config := &Config{FormatExtensions: map[string]string{"image/jpgpng": ".jpgpng"}}
+	expected := map[string]string{".png": "image/png", ".jpeg": "image/jpeg", ".pbf": "application/vnd.mapbox-vector-tile", ".jpgpng": "image/jpgpng"}
+
+	for extension, format := range expected {
+		result, err := config.getFormat(extension)
+		if err != nil || result != format {
+			t.Errorf("Expected %s for %s but was not, got: %s", format, extension, result)
+		}
+	}
+
+	if result, _ := (&Config{}).getFormat(".png"); result != "image/png" {
+		t.Errorf("Expected image/png for .png by default, got: %s", result)
+	}
+}
+
+func TestConfigInitUnknownMode(t *testing.T) {
+	config := &Config{Mode: "both"}
+	if err := config.Init(); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
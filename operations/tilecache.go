@@ -0,0 +1,272 @@
+package operations
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Part of the cache size a single tile may take, larger tiles are not cached
+const maxTileCacheEntryFraction = 8
+
+// TileCache is a bounded in memory LRU cache for the GetTile responses of the upstream,
+// keyed on the upstream and the rewritten RESTful URL. Responses are cached as long as
+// the Cache-Control or Expires header of the upstream allows, responses without either
+// are cached for the configured TTL.
+type TileCache struct {
+	next       http.Handler
+	maxBytes   int64
+	defaultTTL time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// TileCacheStats are the counters of the tile cache
+type TileCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type tileCacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (e *tileCacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for k, values := range e.header {
+		for _, v := range values {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// NewTileCache returns a tile cache in front of next, sized and configured by the config
+func NewTileCache(config *Config, next http.Handler) *TileCache {
+	return &TileCache{
+		next:       next,
+		maxBytes:   int64(config.TileCacheSize),
+		defaultTTL: config.TileCacheTTL,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// ServeHTTP answers GetTile requests from the cache when possible, all other
+// requests and cache misses are passed on to next
+func (c *TileCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	info := GetRequestInfo(r)
+	if info == nil || info.Operation != OperationGetTile || r.Method != http.MethodGet || len(r.Header.Get("Range")) > 0 {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := upstreamRequestKey(r, info)
+	now := time.Now()
+	if e, ok := c.get(key, now); ok {
+		c.hits.Add(1)
+		header := w.Header()
+		for k, v := range e.header {
+			header[k] = append([]string(nil), v...)
+		}
+		header.Set("Age", strconv.Itoa(int(now.Sub(e.stored)/time.Second)))
+		header.Set("X-Cache", "HIT")
+		w.WriteHeader(e.status)
+		w.Write(e.body)
+		return
+	}
+
+	c.misses.Add(1)
+	rec := &tileCacheRecorder{ResponseWriter: w, limit: c.maxBytes / maxTileCacheEntryFraction}
+	c.next.ServeHTTP(rec, r)
+
+	if rec.status != http.StatusOK || rec.overflow || !rec.complete() {
+		return
+	}
+	ttl, ok := tileCacheTTL(rec.header, now, c.defaultTTL)
+	if !ok {
+		return
+	}
+	c.add(&tileCacheEntry{key: key, status: rec.status, header: rec.header, body: rec.body.Bytes(), stored: now, expires: now.Add(ttl)})
+}
+
+// Stats returns the hit and miss counters and the current size of the cache
+func (c *TileCache) Stats() TileCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return TileCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: c.lru.Len(), Bytes: c.size}
+}
+
+// get returns the entry for the key when it is still fresh
+func (c *TileCache) get(key string, now time.Time) (*tileCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := element.Value.(*tileCacheEntry)
+	if !now.Before(e.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return e, true
+}
+
+// add stores the entry and evicts the least recently used entries until the cache fits
+func (c *TileCache) add(e *tileCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[e.key]; ok {
+		c.remove(element)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *TileCache) remove(element *list.Element) {
+	e := c.lru.Remove(element).(*tileCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// tileCacheTTL returns how long a response may be cached according to its headers,
+// it returns false when the response must not be cached
+func tileCacheTTL(header http.Header, now time.Time, defaultTTL time.Duration) (time.Duration, bool) {
+	if len(header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	for _, vary := range header.Values("Vary") {
+		for _, v := range strings.Split(vary, ",") {
+			if v = strings.TrimSpace(v); len(v) > 0 && !strings.EqualFold(v, "Accept-Encoding") {
+				return 0, false
+			}
+		}
+	}
+
+	ttl, found := time.Duration(0), false
+	var maxAge, sMaxAge = -1, -1
+	for _, cacheControl := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				maxAge = parseSeconds(value)
+			case "s-maxage":
+				sMaxAge = parseSeconds(value)
+			}
+		}
+	}
+
+	switch {
+	case sMaxAge >= 0:
+		ttl, found = time.Duration(sMaxAge)*time.Second, true
+	case maxAge >= 0:
+		ttl, found = time.Duration(maxAge)*time.Second, true
+	case len(header.Get("Expires")) > 0:
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl, found = expires.Sub(date), true
+	}
+
+	if !found {
+		ttl = defaultTTL
+	} else if age := parseSeconds(header.Get("Age")); age > 0 {
+		ttl -= time.Duration(age) * time.Second
+	}
+	return ttl, ttl > 0
+}
+
+// parseSeconds parses a delta-seconds value, it returns -1 when the value is invalid
+func parseSeconds(value string) int {
+	seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return seconds
+}
+
+// tileCacheRecorder passes the response on to the client while keeping a copy of it
+type tileCacheRecorder struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *tileCacheRecorder) WriteHeader(code int) {
+	if rec.header == nil {
+		rec.status = code
+		rec.header = rec.ResponseWriter.Header().Clone()
+		rec.ResponseWriter.Header().Set("X-Cache", "MISS")
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *tileCacheRecorder) Write(b []byte) (int, error) {
+	if rec.header == nil {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.limit {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	if err != nil {
+		// the client is gone, the copy might be incomplete
+		rec.overflow = true
+	}
+	return n, err
+}
+
+// complete checks if the whole response is recorded
+func (rec *tileCacheRecorder) complete() bool {
+	if rec.header == nil {
+		return false
+	}
+	length := rec.header.Get("Content-Length")
+	return len(length) == 0 || length == strconv.Itoa(rec.body.Len())
+}
+
+// Unwrap gives the http.ResponseController access to the underlying ResponseWriter
+func (rec *tileCacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,133 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingUpstream answers every request with the configured header and body and counts the requests
+type countingUpstream struct {
+	header   http.Header
+	status   int
+	body     string
+	requests int
+}
+
+func (u *countingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.requests++
+	for k, v := range u.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(u.status)
+	w.Write([]byte(u.body))
+}
+
+func newTestTileCache(t *testing.T, size ByteSize, upstream http.Handler) *TileCache {
+	return NewTileCache(testConfig(t, &Config{Host: "http://default", TileCacheSize: size, TileCacheTTL: time.Minute})(), upstream)
+}
+
+func tileRequest(operation string, path string) *http.Request {
+	r, info := WithRequestInfo(httptest.NewRequest("GET", path, nil))
+	info.Operation = operation
+	info.Layer = "osm"
+	return r
+}
+
+func TestTileCacheHit(t *testing.T) {
+	upstream := &countingUpstream{header: http.Header{"Content-Type": {"image/png"}}, status: 200, body: "tile"}
+	cache := newTestTileCache(t, 1024, upstream)
+
+	for i, expected := range []string{"MISS", "HIT", "HIT"} {
+		w := httptest.NewRecorder()
+		cache.ServeHTTP(w, tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+		if w.Body.String() != "tile" || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("X-Cache") != expected {
+			t.Errorf("Expected a tile with X-Cache %s for request %d, got: %s %v", expected, i, w.Body.String(), w.Header())
+		}
+	}
+	if upstream.requests != 1 {
+		t.Errorf("Expected 1 request to the upstream, got: %d", upstream.requests)
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Expected 2 hits, 1 miss and 1 entry, got: %+v", stats)
+	}
+}
+
+func TestTileCacheOnlyGetTile(t *testing.T) {
+	upstream := &countingUpstream{status: 200, body: "info"}
+	cache := newTestTileCache(t, 1024, upstream)
+
+	for i := 0; i < 2; i++ {
+		cache.ServeHTTP(httptest.NewRecorder(), tileRequest("GetFeatureInfo", "/wmts/osm/EPSG:3857/01/0/0/1/1.html"))
+	}
+	if upstream.requests != 2 {
+		t.Errorf("Expected 2 requests to the upstream, got: %d", upstream.requests)
+	}
+}
+
+func TestTileCacheNotCacheable(t *testing.T) {
+	expected := map[string]*countingUpstream{
+		"no-store":   {header: http.Header{"Cache-Control": {"no-store"}}, status: 200},
+		"max-age=0":  {header: http.Header{"Cache-Control": {"public, max-age=0"}}, status: 200},
+		"expired":    {header: http.Header{"Expires": {"Thu, 01 Jan 1970 00:00:00 GMT"}}, status: 200},
+		"set-cookie": {header: http.Header{"Set-Cookie": {"a=b"}}, status: 200},
+		"vary":       {header: http.Header{"Vary": {"Authorization"}}, status: 200},
+		"not found":  {status: 404},
+	}
+
+	for name, upstream := range expected {
+		cache := newTestTileCache(t, 1024, upstream)
+		for i := 0; i < 2; i++ {
+			cache.ServeHTTP(httptest.NewRecorder(), tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+		}
+		if upstream.requests != 2 {
+			t.Errorf("Expected 2 requests to the upstream for %s, got: %d", name, upstream.requests)
+		}
+	}
+}
+
+func TestTileCacheEviction(t *testing.T) {
+	upstream := &countingUpstream{status: 200, body: strings.Repeat("x", 100)}
+	cache := newTestTileCache(t, 1000, upstream)
+
+	for _, tile := range []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "0"} {
+		cache.ServeHTTP(httptest.NewRecorder(), tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/"+tile+".png"))
+	}
+	if stats := cache.Stats(); stats.Bytes > 1000 || stats.Hits != 0 {
+		t.Errorf("Expected the cache to stay under 1000 bytes and the first tile to be evicted, got: %+v", stats)
+	}
+}
+
+func TestTileCacheTooLarge(t *testing.T) {
+	upstream := &countingUpstream{status: 200, body: strings.Repeat("x", 200)}
+	cache := newTestTileCache(t, 1000, upstream)
+
+	cache.ServeHTTP(httptest.NewRecorder(), tileRequest("GetTile", "/wmts/osm/EPSG:3857/01/0/0.png"))
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Errorf("Expected a tile larger than an eighth of the cache not to be cached, got: %+v", stats)
+	}
+}
+
+func TestTileCacheTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	expected := map[string]struct {
+		header http.Header
+		ttl    time.Duration
+	}{
+		"max-age":  {http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		"s-maxage": {http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute},
+		"age":      {http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second},
+		"expires":  {http.Header{"Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 12:00:00 GMT"}}, time.Hour},
+		"default":  {http.Header{"Content-Type": {"image/png"}}, 5 * time.Minute},
+		"gzip":     {http.Header{"Vary": {"Accept-Encoding"}}, 5 * time.Minute},
+	}
+
+	for name, e := range expected {
+		ttl, ok := tileCacheTTL(e.header, now, 5*time.Minute)
+		if !ok || ttl != e.ttl {
+			t.Errorf("Expected a TTL of %s for %s, got: %s %t", e.ttl, name, ttl, ok)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package operations
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Upstream routes the layers matching the Layer glob pattern to Host, the
+// timeouts override the upstream timeouts of the config for this host
+type Upstream struct {
+	Layer           string        `yaml:"layer"`
+	Host            string        `yaml:"host"`
+	ConnectTimeout  time.Duration `yaml:"connectTimeout,omitempty"`
+	ResponseTimeout time.Duration `yaml:"responseTimeout,omitempty"`
+
+	origin *url.URL
+}
+
+// ParseUpstream parses an upstream in the form <layer>=<host>, where layer is a glob pattern
+func ParseUpstream(value string) (Upstream, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return Upstream{}, fmt.Errorf("upstream %q must be in the form <layer>=<host>", value)
+	}
+	return Upstream{Layer: value[:i], Host: value[i+1:]}, nil
+}
+
+// parseOrigin parses a host with protocol, like http://localhost:8080
+func parseOrigin(host string) (*url.URL, error) {
+	origin, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host %q: %w", host, err)
+	}
+	if (origin.Scheme != "http" && origin.Scheme != "https") || len(origin.Host) == 0 {
+		return nil, fmt.Errorf("invalid host %q, expected http(s)://<host>[:port]", host)
+	}
+	return origin, nil
+}
+
+// initUpstreams parses the default host and the hosts of the upstreams
+func (c *Config) initUpstreams() error {
+	var err error
+	if len(c.Host) > 0 {
+		c.origin, err = parseOrigin(c.Host)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Upstreams {
+		u := &c.Upstreams[i]
+		if _, err := path.Match(u.Layer, ""); err != nil {
+			return fmt.Errorf("upstream %s has an invalid layer pattern %q: %w", u.Host, u.Layer, err)
+		}
+		u.origin, err = parseOrigin(u.Host)
+		if err != nil {
+			return fmt.Errorf("upstream for layer %s: %w", u.Layer, err)
+		}
+	}
+	return nil
+}
+
+// Upstream returns the origin of the upstream for the layer, this is the first upstream
+// with a matching layer pattern. Without a match, or without a layer, the default host is used.
+func (c *Config) Upstream(layer string) *url.URL {
+	if len(layer) > 0 {
+		for _, u := range c.Upstreams {
+			if ok, _ := path.Match(u.Layer, layer); ok && u.origin != nil {
+				return u.origin
+			}
+		}
+	}
+	return c.origin
+}
+
+// setUpstream records the upstream the request is proxied to, when the request has a RequestInfo
+func (c *Config) setUpstream(r *http.Request) {
+	if info := GetRequestInfo(r); info != nil {
+		info.Upstream = c.Upstream(info.Layer)
+	}
+}
+
+// upstreamRequestKey identifies the rewritten request by the upstream it goes to, its
+// RESTful URL and the accepted encodings, as these determine the upstream response
+func upstreamRequestKey(r *http.Request, info *RequestInfo) string {
+	var upstream string
+	if info.Upstream != nil {
+		upstream = info.Upstream.String()
+	}
+	return upstream + r.URL.RequestURI() + "\n" + r.Header.Get("Accept-Encoding")
+}
@@ -0,0 +1,78 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseUpstream(t *testing.T) {
+	upstream, err := ParseUpstream("brt*=http://mapproxy-brt:8080")
+	if err != nil || upstream.Layer != "brt*" || upstream.Host != "http://mapproxy-brt:8080" {
+		t.Errorf("Expected brt* and http://mapproxy-brt:8080, got: %v, %v", upstream, err)
+	}
+
+	if _, err := ParseUpstream("http://mapproxy-brt:8080"); err == nil {
+		t.Errorf("Expected an error for an upstream without layer")
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	config := &Config{Host: "http://default", Upstreams: []Upstream{{Layer: "brt*", Host: "http://brt:8080"}, {Layer: "luchtfoto", Host: "https://luchtfoto"}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{"brtachtergrondkaart": "brt:8080", "luchtfoto": "luchtfoto", "luchtfoto2": "default", "": "default"}
+	for layer, host := range expected {
+		if config.Upstream(layer).Host != host {
+			t.Errorf("Expected %s for layer %s but was not, got: %s", host, layer, config.Upstream(layer).Host)
+		}
+	}
+}
+
+func TestUpstreamInvalidHost(t *testing.T) {
+	config := &Config{Host: "http://default", Upstreams: []Upstream{{Layer: "brt*", Host: "brt:8080"}}}
+	if err := config.Init(); err == nil {
+		t.Errorf("Expected an error for an upstream without protocol")
+	}
+}
+
+func TestProcessRequestRecordsLayer(t *testing.T) {
+	config := &Config{Host: "http://default", Upstreams: []Upstream{{Layer: "a", Host: "http://a"}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+		RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=a&tilematrixset=b&tilematrix=c&tilecol=4&tilerow=5&format=image/png"}, Header: http.Header{}}
+	mockRequest, info := WithRequestInfo(mockRequest)
+
+	if !ProcessRequest(config, httptest.NewRecorder(), mockRequest) {
+		t.Fatalf("Expected request to be proxied")
+	}
+	if GetRequestInfo(mockRequest) != info || info.Layer != "a" {
+		t.Errorf("Expected layer a in the request info, got: %s", info.Layer)
+	}
+	if config.Upstream(info.Layer).Host != "a" {
+		t.Errorf("Expected upstream a but was not, got: %s", config.Upstream(info.Layer).Host)
+	}
+}
+
+func TestProcessRequestRESTfulPassThroughUpstream(t *testing.T) {
+	config := &Config{Host: "http://default", Upstreams: []Upstream{{Layer: "a", Host: "http://a"}}}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	for path, host := range map[string]string{"/wmts/a/b/c/4/5.png": "a", "/wmts/a/b/c/4/5.jpg": "a", "/wmts/other/b/c/4/5.png": "default"} {
+		mockRequest, info := WithRequestInfo(httptest.NewRequest("GET", path, nil))
+		if !ProcessRequest(config, httptest.NewRecorder(), mockRequest) {
+			t.Fatalf("Expected %s to be proxied", path)
+		}
+		if mockRequest.URL.Path != path || info.Upstream == nil || info.Upstream.Host != host {
+			t.Errorf("Expected %s to be passed through to upstream %s, got: %s %v", path, host, mockRequest.URL.Path, info.Upstream)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Default time the capabilities fetched from the upstream are cached
+const defaultCapabilitiesTTL = 5 * time.Minute
+
+// Public location of the service, as used in a GetCapabilities template
+const publicURL = `{{ .Protocol }}://{{ .Host }}{{ .Path }}`
+
+const getEncodingKVP = `<ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>KVP</ows:Value></ows:AllowedValues></ows:Constraint>`
+
+// OperationsMetadata for capabilities documents without one, like the RESTful capabilities of MapProxy
+const (
+	operationsMetadataStart = `<ows:OperationsMetadata xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink">`
+	operationXML            = `<ows:Operation name="%s"><ows:DCP><ows:HTTP><ows:Get xlink:href="` + publicURL + `?">` + getEncodingKVP + `</ows:Get></ows:HTTP></ows:DCP></ows:Operation>`
+	operationsMetadataEnd   = `</ows:OperationsMetadata>`
+)
+
+var (
+	urlAttributeRegex  = regexp.MustCompile(`\b(xlink:href|template)="([^"]*)"`)
+	getElementRegex    = regexp.MustCompile(`(?s)<ows:Get\b([^>]*?)(/>|>(.*?)</ows:Get>)`)
+	allowedValuesRegex = regexp.MustCompile(`(?s)(<ows:Constraint name="GetEncoding">.*?<ows:AllowedValues>)(.*?)(</ows:AllowedValues>)`)
+	contentsRegex      = regexp.MustCompile(`<(\w+:)?Contents\b`)
+)
+
+// upstreamCapabilities fetches the capabilities documents from the upstream and caches
+// them, rewritten to GetCapabilities templates, by request path. Every path is fetched by
+// one request at a time, without blocking the requests for the other paths, and only a
+// limited number of paths is fetched at the same time.
+type upstreamCapabilities struct {
+	client *http.Client
+	ttl    time.Duration
+	// fetches holds a slot for every fetch in flight
+	fetches chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]*cachedCapabilities
+}
+
+type cachedCapabilities struct {
+	template     *template.Template
+	capabilities *capabilities
+	err          error
+	expires      time.Time
+	// fetching is closed when the running fetch is done
+	fetching chan struct{}
+}
+
+// Time a failed fetch is cached, the number of paths with cached capabilities, the number of
+// fetches in flight and the maximum size of a capabilities document
+const (
+	capabilitiesFailureTTL  = 10 * time.Second
+	maxCachedCapabilities   = 100
+	maxCapabilitiesFetches  = 4
+	maxCapabilitiesDocument = 10 << 20
+)
+
+var errCapabilitiesBusy = errors.New("too many capabilities fetches in flight")
+
+// newUpstreamCapabilities returns the cache fetching the capabilities with transport, which
+// should be the upstream transport so the fetches have its timeouts and circuit breaker
+func newUpstreamCapabilities(ttl time.Duration, transport http.RoundTripper) *upstreamCapabilities {
+	if ttl <= 0 {
+		ttl = defaultCapabilitiesTTL
+	}
+	return &upstreamCapabilities{client: &http.Client{Transport: transport, Timeout: 30 * time.Second}, ttl: ttl,
+		fetches: make(chan struct{}, maxCapabilitiesFetches), cache: map[string]*cachedCapabilities{}}
+}
+
+// get returns the GetCapabilities template and the parsed capabilities for the path, when the
+// cached document is expired it is fetched again. While it is fetched, when that fails and when
+// there are too many fetches in flight, the expired document is used. A failure without a
+// document is cached for a short time.
+func (u *upstreamCapabilities) get(origin *url.URL, path string) (cachedCapabilities, error) {
+	u.mu.Lock()
+	cached, ok := u.cache[path]
+	if ok && (time.Now().Before(cached.expires) || (cached.fetching != nil && cached.template != nil)) {
+		result := *cached
+		u.mu.Unlock()
+		return result, result.err
+	}
+	if ok && cached.fetching != nil {
+		// wait for the first fetch of the path
+		fetching := cached.fetching
+		u.mu.Unlock()
+		<-fetching
+		u.mu.Lock()
+		result := *cached
+		u.mu.Unlock()
+		return result, result.err
+	}
+	select {
+	case u.fetches <- struct{}{}:
+	default:
+		var result cachedCapabilities
+		if ok && cached.template != nil {
+			result = *cached
+		}
+		u.mu.Unlock()
+		if result.template == nil {
+			return result, errCapabilitiesBusy
+		}
+		return result, nil
+	}
+	if !ok {
+		u.evict()
+		cached = &cachedCapabilities{}
+		u.cache[path] = cached
+	}
+	fetching := make(chan struct{})
+	cached.fetching = fetching
+	u.mu.Unlock()
+
+	fetched, err := u.fetch(origin, path)
+	<-u.fetches
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case err == nil:
+		cached.template, cached.capabilities, cached.err = fetched.template, fetched.capabilities, nil
+		cached.expires = time.Now().Add(u.ttl)
+	case cached.template != nil:
+		log.Printf("using expired capabilities for %s: %v", path, err)
+		cached.expires = time.Now().Add(u.ttl)
+	default:
+		log.Printf("no capabilities for %s until the next attempt in %s: %v", path, capabilitiesFailureTTL, err)
+		cached.err = err
+		cached.expires = time.Now().Add(capabilitiesFailureTTL)
+	}
+	cached.fetching = nil
+	close(fetching)
+	return *cached, cached.err
+}
+
+// cached returns the parsed capabilities for the path without fetching a path that has no
+// document, so requests on arbitrary paths don't cause requests to the upstream. An expired
+// document is used while it is fetched again in the background.
+func (u *upstreamCapabilities) cached(origin *url.URL, path string) *capabilities {
+	u.mu.Lock()
+	cached, ok := u.cache[path]
+	if !ok || cached.template == nil {
+		u.mu.Unlock()
+		return nil
+	}
+	result := cached.capabilities
+	refresh := cached.fetching == nil && !time.Now().Before(cached.expires)
+	u.mu.Unlock()
+
+	if refresh {
+		go u.get(origin, path)
+	}
+	return result
+}
+
+// failed returns the error of the last failed fetch when none of the paths has capabilities,
+// nil when capabilities are loaded or nothing has been fetched yet
+func (u *upstreamCapabilities) failed() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var err error
+	now := time.Now()
+	for path, cached := range u.cache {
+		if cached.template != nil {
+			return nil
+		}
+		if cached.err != nil && now.Before(cached.expires) {
+			err = fmt.Errorf("no capabilities for %s: %w", path, cached.err)
+		}
+	}
+	return err
+}
+
+// evict makes room for another path when the cache is full, by removing the entry that expires
+// first. Paths that are being fetched are kept, there are fewer of them than fit in the cache.
+// The lock must be held.
+func (u *upstreamCapabilities) evict() {
+	if len(u.cache) < maxCachedCapabilities {
+		return
+	}
+	var oldest *cachedCapabilities
+	var oldestPath string
+	for path, cached := range u.cache {
+		if cached.fetching == nil && (oldest == nil || cached.expires.Before(oldest.expires)) {
+			oldest, oldestPath = cached, path
+		}
+	}
+	if oldest != nil {
+		delete(u.cache, oldestPath)
+	}
+}
+
+// fetch requests the capabilities from the upstream on the same path as the incoming request
+func (u *upstreamCapabilities) fetch(origin *url.URL, path string) (cachedCapabilities, error) {
+	capabilitiesURL := *origin
+	capabilitiesURL.Path = path
+	capabilitiesURL.RawQuery = "SERVICE=WMTS&REQUEST=GetCapabilities&VERSION=1.0.0"
+
+	resp, err := u.client.Get(capabilitiesURL.String())
+	if err != nil {
+		return cachedCapabilities{}, fmt.Errorf("could not fetch capabilities from upstream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return cachedCapabilities{}, fmt.Errorf("could not fetch capabilities from upstream: %s returned %d", capabilitiesURL.String(), resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCapabilitiesDocument+1))
+	if err != nil {
+		return cachedCapabilities{}, fmt.Errorf("could not read capabilities from upstream: %w", err)
+	}
+	if len(body) > maxCapabilitiesDocument {
+		return cachedCapabilities{}, fmt.Errorf("could not read capabilities from upstream: larger than %d bytes", maxCapabilitiesDocument)
+	}
+
+	t, err := template.New(path).Parse(capabilitiesToTemplate(string(body), origin, path))
+	if err != nil {
+		return cachedCapabilities{}, fmt.Errorf("could not parse capabilities from upstream: %w", err)
+	}
+
+	// without the parsed capabilities the requests are not validated, but the document can still be served
+	c, err := parseCapabilities(t)
+	if err != nil {
+		log.Printf("could not parse capabilities from upstream, requests for %s are not validated: %v", path, err)
+	}
+	return cachedCapabilities{template: t, capabilities: c}, nil
+}
+
+// capabilitiesToTemplate rewrites a capabilities document from the upstream to a GetCapabilities template.
+// Every xlink:href and ResourceURL template pointing to the upstream is rewritten to the public location,
+// and all the operations get a KVP GetEncoding constraint.
+func capabilitiesToTemplate(doc string, origin *url.URL, path string) string {
+	// the document should not be interpreted as template
+	doc = strings.ReplaceAll(doc, "{{", `{{"{{"}}`)
+
+	doc = urlAttributeRegex.ReplaceAllStringFunc(doc, func(attribute string) string {
+		groups := urlAttributeRegex.FindStringSubmatch(attribute)
+		return fmt.Sprintf(`%s="%s"`, groups[1], rewriteUpstreamURL(groups[2], origin, path))
+	})
+
+	doc = getElementRegex.ReplaceAllStringFunc(doc, func(element string) string {
+		groups := getElementRegex.FindStringSubmatch(element)
+		attributes, content := groups[1], groups[3]
+		if !strings.Contains(content, `name="GetEncoding"`) {
+			content = getEncodingKVP + content
+		} else if !strings.Contains(content, ">KVP<") {
+			content = allowedValuesRegex.ReplaceAllString(content, `${1}${2}<ows:Value>KVP</ows:Value>${3}`)
+		}
+		return "<ows:Get" + attributes + ">" + content + "</ows:Get>"
+	})
+
+	if !strings.Contains(doc, "OperationsMetadata") {
+		operations := []string{"GetCapabilities", "GetTile"}
+		if strings.Contains(doc, `resourceType="FeatureInfo"`) {
+			operations = append(operations, "GetFeatureInfo")
+		}
+		if loc := contentsRegex.FindStringIndex(doc); loc != nil {
+			var b strings.Builder
+			b.WriteString(operationsMetadataStart)
+			for _, operation := range operations {
+				fmt.Fprintf(&b, operationXML, operation)
+			}
+			b.WriteString(operationsMetadataEnd)
+			doc = doc[:loc[0]] + b.String() + doc[loc[0]:]
+		}
+	}
+	return doc
+}
+
+// rewriteUpstreamURL replaces the protocol, host and path of an URL pointing to
+// the upstream with the public location, other URLs are left untouched
+func rewriteUpstreamURL(value string, origin *url.URL, path string) string {
+	i := strings.Index(value, "://")
+	if i < 0 {
+		return value
+	}
+	rest := value[i+3:]
+	host, remainder := rest, ""
+	if j := strings.IndexAny(rest, "/?"); j >= 0 {
+		host, remainder = rest[:j], rest[j:]
+	}
+	if !strings.EqualFold(hostname(host), origin.Hostname()) {
+		return value
+	}
+
+	trimmed := strings.TrimRight(path, "/")
+	if remainder == trimmed || strings.HasPrefix(remainder, trimmed+"/") || strings.HasPrefix(remainder, trimmed+"?") {
+		return publicURL + remainder[len(trimmed):]
+	}
+	return `{{ .Protocol }}://{{ .Host }}` + remainder
+}
+
+// hostname strips the port from host
+func hostname(host string) string {
+	u := url.URL{Host: host}
+	return u.Hostname()
+}
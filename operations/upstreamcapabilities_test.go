@@ -0,0 +1,301 @@
+package operations
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const upstreamRESTfulCapabilities = `<?xml version="1.0"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">
+  <ows:ServiceProvider>
+    <ows:ProviderSite xlink:href="https://www.pdok.nl"/>
+  </ows:ServiceProvider>
+  <Contents>
+    <Layer>
+      <ows:Identifier>osm</ows:Identifier>
+      <ResourceURL format="image/png" resourceType="tile" template="http://mapproxy/wmts/osm/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}.png"/>
+    </Layer>
+  </Contents>
+  <ServiceMetadataURL xlink:href="http://mapproxy/wmts/1.0.0/WMTSCapabilities.xml"/>
+</Capabilities>`
+
+const upstreamKVPCapabilities = `<?xml version="1.0"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">
+  <ows:OperationsMetadata>
+    <ows:Operation name="GetCapabilities">
+      <ows:DCP>
+        <ows:HTTP>
+          <ows:Get xlink:href="http://mapproxy:8080/wmts?"/>
+        </ows:HTTP>
+      </ows:DCP>
+    </ows:Operation>
+    <ows:Operation name="GetTile">
+      <ows:DCP>
+        <ows:HTTP>
+          <ows:Get xlink:href="http://mapproxy:8080/wmts?">
+            <ows:Constraint name="GetEncoding">
+              <ows:AllowedValues>
+                <ows:Value>RESTful</ows:Value>
+              </ows:AllowedValues>
+            </ows:Constraint>
+          </ows:Get>
+        </ows:HTTP>
+      </ows:DCP>
+    </ows:Operation>
+  </ows:OperationsMetadata>
+  <Contents/>
+</Capabilities>`
+
+func TestCapabilitiesToTemplateRESTful(t *testing.T) {
+	origin, _ := url.Parse("http://mapproxy:80")
+	result := capabilitiesToTemplate(upstreamRESTfulCapabilities, origin, "/wmts")
+
+	expected := []string{
+		`template="{{ .Protocol }}://{{ .Host }}{{ .Path }}/osm/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}.png"`,
+		`<ServiceMetadataURL xlink:href="{{ .Protocol }}://{{ .Host }}{{ .Path }}/1.0.0/WMTSCapabilities.xml"/>`,
+		`xlink:href="https://www.pdok.nl"`,
+		`<ows:Operation name="GetTile"><ows:DCP><ows:HTTP><ows:Get xlink:href="{{ .Protocol }}://{{ .Host }}{{ .Path }}?">` + getEncodingKVP,
+	}
+	for _, e := range expected {
+		if !strings.Contains(result, e) {
+			t.Errorf("Expected %s but was not, got: %s", e, result)
+		}
+	}
+	if strings.Index(result, "OperationsMetadata") > strings.Index(result, "<Contents>") {
+		t.Errorf("Expected OperationsMetadata before Contents, got: %s", result)
+	}
+}
+
+func TestCapabilitiesToTemplateKVP(t *testing.T) {
+	origin, _ := url.Parse("http://mapproxy:8080")
+	result := capabilitiesToTemplate(upstreamKVPCapabilities, origin, "/wmts")
+
+	if strings.Count(result, `xlink:href="{{ .Protocol }}://{{ .Host }}{{ .Path }}?"`) != 2 {
+		t.Errorf("Expected both operations to be rewritten, got: %s", result)
+	}
+	if strings.Count(result, "<ows:Value>KVP</ows:Value>") != 2 {
+		t.Errorf("Expected both operations to allow KVP, got: %s", result)
+	}
+	if !strings.Contains(result, "<ows:Value>RESTful</ows:Value>") {
+		t.Errorf("Expected RESTful to be kept, got: %s", result)
+	}
+}
+
+func TestProcessGetCapabilitiesRequestUpstream(t *testing.T) {
+	var requests int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/wmts" || r.URL.Query().Get("REQUEST") != "GetCapabilities" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(strings.ReplaceAll(upstreamRESTfulCapabilities, "http://mapproxy", "http://"+r.Host)))
+	}))
+	defer upstream.Close()
+
+	config := &Config{Host: upstream.URL, UpstreamCapabilities: true, CapabilitiesTTL: time.Minute}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts",
+			RawQuery: "service=WMTS&request=GetCapabilities"}, Header: http.Header{"X-Forwarded-Proto": {"https"}}}
+		w := httptest.NewRecorder()
+
+		if ProcessRequest(config, w, mockRequest) {
+			t.Fatalf("Expected the capabilities not to be proxied")
+		}
+		expected := `template="https://example.com/wmts/osm/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}.png"`
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected %s but was not, got: %s", expected, w.Body.String())
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the capabilities to be cached, got %d upstream requests", requests)
+	}
+}
+
+func TestProcessGetCapabilitiesRequestUpstreamError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	config := &Config{Host: upstream.URL, UpstreamCapabilities: true}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/wmts"}, Header: http.Header{}}
+	err := ProcessGetCapabilitiesRequest(config, httptest.NewRecorder(), mockRequest)
+	if err == nil || err.Status() != http.StatusBadGateway {
+		t.Errorf("Expected a bad gateway exception, got: %v", err)
+	}
+}
+
+func TestUpstreamCapabilitiesConcurrentFetch(t *testing.T) {
+	var requests atomic.Int64
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		if r.URL.Path != "/wmts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(upstreamRESTfulCapabilities))
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+	u := newUpstreamCapabilities(time.Minute, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cached, err := u.get(origin, "/wmts"); err != nil || cached.template == nil {
+				t.Errorf("Expected the capabilities, got: %v", err)
+			}
+		}()
+	}
+	// another path is not blocked by the running fetch
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := u.get(origin, "/other"); err == nil {
+			t.Errorf("Expected an error for an unknown path")
+		}
+	}
+	wg.Wait()
+	if requests.Load() != 2 {
+		t.Errorf("Expected one upstream request per path, the failure included, got: %d", requests.Load())
+	}
+}
+
+func TestUpstreamCapabilitiesEvict(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+	u := newUpstreamCapabilities(time.Minute, nil)
+
+	for i := 0; i < maxCachedCapabilities+10; i++ {
+		u.get(origin, fmt.Sprintf("/wmts%d", i))
+	}
+	if len(u.cache) != maxCachedCapabilities {
+		t.Errorf("Expected %d cached paths, got: %d", maxCachedCapabilities, len(u.cache))
+	}
+	if _, ok := u.cache["/wmts0"]; ok {
+		t.Errorf("Expected the oldest path to be evicted")
+	}
+}
+
+func TestUpstreamCapabilitiesFailureLoggedOnce(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+	u := newUpstreamCapabilities(time.Minute, nil)
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	for i := 0; i < 3; i++ {
+		if _, err := u.get(origin, "/wmts"); err == nil {
+			t.Errorf("Expected an error")
+		}
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Errorf("Expected the failure to be logged once, got: %s", out.String())
+	}
+}
+
+func TestUpstreamCapabilitiesValidationDoesNotFetch(t *testing.T) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(upstreamRESTfulCapabilities))
+	}))
+	defer upstream.Close()
+	config := &Config{Host: upstream.URL, UpstreamCapabilities: true}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	for _, path := range []string{"/wmts", "/random1", "/random2"} {
+		if config.getCapabilities(path) != nil {
+			t.Errorf("Expected no capabilities for %s before they are fetched", path)
+		}
+	}
+	if requests.Load() != 0 {
+		t.Errorf("Expected no upstream requests for the validation, got: %d", requests.Load())
+	}
+
+	if _, err := config.upstreamCapabilities.get(config.origin, "/wmts"); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+	if config.getCapabilities("/wmts") == nil {
+		t.Errorf("Expected the fetched capabilities to be used for the validation")
+	}
+}
+
+func TestUpstreamCapabilitiesFetchLimit(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(upstreamRESTfulCapabilities))
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+	u := newUpstreamCapabilities(time.Minute, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxCapabilitiesFetches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u.get(origin, fmt.Sprintf("/wmts%d", i))
+		}(i)
+	}
+	for len(u.fetches) < maxCapabilitiesFetches {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := u.get(origin, "/other"); err != errCapabilitiesBusy {
+		t.Errorf("Expected the fetch to be refused while the others are in flight, got: %v", err)
+	}
+	if _, ok := u.cache["/other"]; ok {
+		t.Errorf("Expected a refused path not to be cached")
+	}
+	close(release)
+	wg.Wait()
+	if _, err := u.get(origin, "/other"); err != nil {
+		t.Errorf("Expected the capabilities once the fetches are done, got: %v", err)
+	}
+}
+
+func TestUpstreamCapabilitiesDocumentLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte(" "), maxCapabilitiesDocument+1))
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+	if _, err := newUpstreamCapabilities(time.Minute, nil).fetch(origin, "/wmts"); err == nil {
+		t.Errorf("Expected an error for a document that is too large")
+	}
+}
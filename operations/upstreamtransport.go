@@ -0,0 +1,249 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of the requests to the upstreams
+const (
+	defaultConnectTimeout  = 5 * time.Second
+	defaultResponseTimeout = 30 * time.Second
+	defaultRetries         = 2
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// Wait before a retry, multiplied by the number of the attempt
+const retryBackoff = 100 * time.Millisecond
+
+// Maximum number of bytes read from a failed response so the connection can be reused
+const drainLimit = 64 << 10
+
+var errCircuitOpen = errors.New("the circuit breaker of the upstream is open")
+
+var (
+	upstreamRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmts_upstream_retries_total",
+		Help: "Number of retried requests to the upstream.",
+	}, []string{"upstream"})
+	circuitBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wmts_circuit_breaker_open",
+		Help: "1 while the circuit breaker of the upstream is open.",
+	}, []string{"upstream"})
+)
+
+// UpstreamTransport does the requests to the upstreams with the connect and response timeouts
+// of the upstream. GetTile requests are retried when the upstream can't be reached or answers
+// with a 502, 503 or 504, as long as the retry can get its response within the write timeout.
+// Every upstream has a circuit breaker, after a number of consecutive
+// failures the requests fail fast until the cooldown has passed and a trial request succeeds.
+type UpstreamTransport struct {
+	config func() *Config
+
+	mu         sync.Mutex
+	transports map[upstreamTimeouts]*http.Transport
+	breakers   map[string]*circuitBreaker
+}
+
+type upstreamTimeouts struct {
+	connect  time.Duration
+	response time.Duration
+}
+
+// NewUpstreamTransport returns the transport for the config in use, config is called on every request
+func NewUpstreamTransport(config func() *Config) *UpstreamTransport {
+	return &UpstreamTransport{config: config, transports: map[upstreamTimeouts]*http.Transport{}, breakers: map[string]*circuitBreaker{}}
+}
+
+func (t *UpstreamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	config := t.config()
+	origin := r.URL.Scheme + "://" + r.URL.Host
+	timeouts := config.upstreamTimeouts(origin)
+	transport, breaker := t.get(origin, timeouts)
+	start := time.Now()
+
+	attempts := 1
+	if retryable(r) {
+		attempts += config.Retries
+	}
+	for attempt := 1; ; attempt++ {
+		if !breaker.allow(config.BreakerFailures, time.Now()) {
+			return nil, errCircuitOpen
+		}
+
+		resp, err := transport.RoundTrip(r)
+		if r.Context().Err() != nil {
+			// the client went away, this says nothing about the upstream
+			breaker.release()
+			return resp, err
+		}
+		failed := err != nil || retryableStatus(resp.StatusCode)
+		breaker.record(failed, config.BreakerFailures, config.BreakerCooldown, time.Now())
+		if !failed || attempt >= attempts || !config.retryFits(start, attempt, timeouts.response, time.Now()) {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.CopyN(io.Discard, resp.Body, drainLimit)
+			resp.Body.Close()
+		}
+		upstreamRetriesTotal.WithLabelValues(breaker.name).Inc()
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(time.Duration(attempt) * retryBackoff):
+		}
+	}
+}
+
+// get returns the transport for the timeouts and the circuit breaker of the origin
+func (t *UpstreamTransport) get(origin string, timeouts upstreamTimeouts) (*http.Transport, *circuitBreaker) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	transport, ok := t.transports[timeouts]
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{Timeout: timeouts.connect, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = timeouts.connect
+		transport.ResponseHeaderTimeout = timeouts.response
+		t.transports[timeouts] = transport
+	}
+	breaker, ok := t.breakers[origin]
+	if !ok {
+		breaker = &circuitBreaker{name: redactURL(origin)}
+		t.breakers[origin] = breaker
+	}
+	return transport, breaker
+}
+
+// upstreamTimeouts returns the timeouts of the first upstream with the origin, or the default timeouts
+func (c *Config) upstreamTimeouts(origin string) upstreamTimeouts {
+	timeouts := upstreamTimeouts{connect: c.ConnectTimeout, response: c.ResponseTimeout}
+	for _, u := range c.Upstreams {
+		if u.origin != nil && u.origin.Scheme+"://"+u.origin.Host == origin {
+			if u.ConnectTimeout > 0 {
+				timeouts.connect = u.ConnectTimeout
+			}
+			if u.ResponseTimeout > 0 {
+				timeouts.response = u.ResponseTimeout
+			}
+			break
+		}
+	}
+	return timeouts
+}
+
+// retryFits tells if a retry after the backoff can get its response before the write timeout
+// has passed, otherwise the client would not get the response anyway
+func (c *Config) retryFits(start time.Time, attempt int, response time.Duration, now time.Time) bool {
+	if c.WriteTimeout <= 0 {
+		return true
+	}
+	return now.Add(time.Duration(attempt)*retryBackoff + response).Before(start.Add(c.WriteTimeout))
+}
+
+// retryable tells if the request can safely be done again, only GetTile requests without a body are retried
+func retryable(r *http.Request) bool {
+	info := GetRequestInfo(r)
+	return info != nil && info.Operation == OperationGetTile &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead) && (r.Body == nil || r.Body == http.NoBody)
+}
+
+// retryableStatus tells if the status means the upstream is unavailable
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// circuitBreaker counts the consecutive failures of an upstream. When the threshold is
+// reached it opens and requests are refused until the cooldown has passed, then a
+// single trial request is let through which closes it again when it succeeds.
+type circuitBreaker struct {
+	name string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow tells if a request can be done, a threshold of 0 disables the circuit breaker
+func (b *circuitBreaker) allow(threshold int, now time.Time) bool {
+	if threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < threshold {
+		return true
+	}
+	if now.Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record keeps the outcome of a request
+func (b *circuitBreaker) record(failed bool, threshold int, cooldown time.Duration, now time.Time) {
+	if threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		if b.failures >= threshold {
+			log.Printf("circuit breaker of upstream %s closed", b.name)
+			circuitBreakerOpen.WithLabelValues(b.name).Set(0)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		if b.failures == threshold {
+			log.Printf("circuit breaker of upstream %s opened after %d failures", b.name, b.failures)
+			circuitBreakerOpen.WithLabelValues(b.name).Set(1)
+		}
+		b.openUntil = now.Add(cooldown)
+	}
+}
+
+// release ends a trial request without an outcome
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// ProxyErrorHandler sends a failed request to the upstream as an exception, it is meant
+// for the ErrorHandler of a httputil.ReverseProxy
+func ProxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var netErr net.Error
+	switch {
+	case r.Context().Err() != nil:
+		// the client went away, there is nobody to tell
+		w.WriteHeader(http.StatusBadGateway)
+	case errors.Is(err, errCircuitOpen):
+		SendError(WMTSException{ErrorMessage: "The upstream is unavailable", ErrorCode: "NoApplicableCode", StatusCode: http.StatusServiceUnavailable}, w, r)
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		log.Printf("upstream request timed out: %v", err)
+		SendError(WMTSException{ErrorMessage: "The upstream did not respond in time", ErrorCode: "NoApplicableCode", StatusCode: http.StatusGatewayTimeout}, w, r)
+	default:
+		log.Printf("upstream request failed: %v", err)
+		SendError(WMTSException{ErrorMessage: "Could not reach the upstream", ErrorCode: "NoApplicableCode", StatusCode: http.StatusBadGateway}, w, r)
+	}
+}
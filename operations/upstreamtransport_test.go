@@ -0,0 +1,137 @@
+package operations
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingUpstream answers the first failures requests with a 503 and the others with a 200
+type failingUpstream struct {
+	failures int64
+	requests atomic.Int64
+}
+
+func (u *failingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.requests.Add(1) <= u.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("tile"))
+}
+
+func TestUpstreamTransportRetries(t *testing.T) {
+	upstream := &failingUpstream{failures: 2}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	transport := NewUpstreamTransport(testConfig(t, &Config{Host: server.URL, Retries: 2}))
+
+	resp, err := transport.RoundTrip(tileRequest(OperationGetTile, server.URL+"/wmts/osm/EPSG:3857/01/0/0.png"))
+	if err != nil || resp.StatusCode != http.StatusOK || upstream.requests.Load() != 3 {
+		t.Errorf("Expected a tile after 2 retries, got: %v %v %d", resp, err, upstream.requests.Load())
+	}
+}
+
+func TestUpstreamTransportNoRetries(t *testing.T) {
+	upstream := &failingUpstream{failures: 2}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	transport := NewUpstreamTransport(testConfig(t, &Config{Host: server.URL, Retries: 2}))
+
+	resp, err := transport.RoundTrip(tileRequest(OperationGetFeatureInfo, server.URL+"/wmts/osm/EPSG:3857/01/0/0/1/1.html"))
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || upstream.requests.Load() != 1 {
+		t.Errorf("Expected GetFeatureInfo not to be retried, got: %v %v %d", resp, err, upstream.requests.Load())
+	}
+}
+
+func TestUpstreamTransportRetriesWriteTimeout(t *testing.T) {
+	upstream := &failingUpstream{failures: 2}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	transport := NewUpstreamTransport(testConfig(t, &Config{Host: server.URL, Retries: 2, ResponseTimeout: time.Second, WriteTimeout: 1250 * time.Millisecond}))
+
+	resp, err := transport.RoundTrip(tileRequest(OperationGetTile, server.URL+"/wmts/osm/EPSG:3857/01/0/0.png"))
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || upstream.requests.Load() != 2 {
+		t.Errorf("Expected a single retry within the write timeout, got: %v %v %d", resp, err, upstream.requests.Load())
+	}
+}
+
+func TestUpstreamTransportCircuitBreaker(t *testing.T) {
+	upstream := &failingUpstream{failures: 3}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	transport := NewUpstreamTransport(testConfig(t, &Config{Host: server.URL, BreakerFailures: 3, BreakerCooldown: 50 * time.Millisecond}))
+
+	for i := 0; i < 3; i++ {
+		transport.RoundTrip(tileRequest(OperationGetTile, server.URL+"/wmts/osm/EPSG:3857/01/0/0.png"))
+	}
+	if _, err := transport.RoundTrip(tileRequest(OperationGetTile, server.URL+"/wmts/osm/EPSG:3857/01/0/0.png")); !errors.Is(err, errCircuitOpen) || upstream.requests.Load() != 3 {
+		t.Errorf("Expected the open circuit breaker to fail fast, got: %v %d", err, upstream.requests.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	resp, err := transport.RoundTrip(tileRequest(OperationGetTile, server.URL+"/wmts/osm/EPSG:3857/01/0/0.png"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the trial request after the cooldown to succeed, got: %v %v", resp, err)
+	}
+	if _, err := transport.RoundTrip(tileRequest(OperationGetTile, server.URL+"/wmts/osm/EPSG:3857/01/0/0.png")); err != nil {
+		t.Errorf("Expected the circuit breaker to be closed, got: %v", err)
+	}
+}
+
+func TestCircuitBreakerTrial(t *testing.T) {
+	b := &circuitBreaker{name: "test"}
+	now := time.Now()
+	b.record(true, 1, time.Second, now)
+
+	if b.allow(1, now) {
+		t.Errorf("Expected the open circuit breaker to refuse a request")
+	}
+	if !b.allow(1, now.Add(2*time.Second)) || b.allow(1, now.Add(2*time.Second)) {
+		t.Errorf("Expected a single trial request after the cooldown")
+	}
+	b.record(true, 1, time.Second, now.Add(2*time.Second))
+	if b.allow(1, now.Add(2*time.Second)) {
+		t.Errorf("Expected a failed trial to open the circuit breaker again")
+	}
+}
+
+func TestUpstreamTransportResponseTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	config := &Config{Host: server.URL, Upstreams: []Upstream{{Layer: "osm", Host: server.URL, ResponseTimeout: 20 * time.Millisecond}}, ResponseTimeout: time.Minute}
+	transport := NewUpstreamTransport(testConfig(t, config))
+
+	r := tileRequest(OperationGetFeatureInfo, server.URL+"/wmts/osm/EPSG:3857/01/0/0/1/1.html")
+	_, err := transport.RoundTrip(r)
+	if err == nil {
+		t.Fatalf("Expected the response timeout of the upstream")
+	}
+
+	w := httptest.NewRecorder()
+	ProxyErrorHandler(w, r, err)
+	if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "ows:ExceptionReport") {
+		t.Errorf("Expected a 504 exception report, got: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyErrorHandler(t *testing.T) {
+	expected := map[error]int{
+		errCircuitOpen:                 http.StatusServiceUnavailable,
+		errors.New("connection reset"): http.StatusBadGateway,
+	}
+
+	for err, status := range expected {
+		w := httptest.NewRecorder()
+		ProxyErrorHandler(w, httptest.NewRequest("GET", "/wmts", nil), err)
+		if w.Code != status || !strings.Contains(w.Body.String(), `exceptionCode="NoApplicableCode"`) {
+			t.Errorf("Expected a %d exception report for %s, got: %d %s", status, err, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package operations
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// getCapabilities returns the parsed capabilities used to validate the requests on the path,
+// or nil when there are none. The capabilities from the upstream are only fetched for a
+// GetCapabilities request, until then the requests on the path are not validated.
+func (c *Config) getCapabilities(path string) *capabilities {
+	if c == nil {
+		return nil
+	}
+	if c.UpstreamCapabilities && c.upstreamCapabilities != nil {
+		return c.upstreamCapabilities.cached(c.origin, path)
+	}
+	return c.capabilities
+}
+
+// getLayerStyle returns the requested style, when the STYLE parameter is missing or empty
+// the default style of the layer from the capabilities is used, or else the configured default
+func (c *Config) getLayerStyle(capabilities *capabilities, query url.Values) string {
+	if capabilities != nil && (len(query["style"]) == 0 || len(query["style"][0]) == 0) {
+		if layer, ok := capabilities.layers[query["layer"][0]]; ok {
+			if style, ok := layer.defaultStyle(); ok {
+				return style
+			}
+		}
+	}
+	return c.getStyle(query)
+}
+
+// validate checks the GetTile or GetFeatureInfo request against the capabilities,
+// so requests that cannot succeed are not sent to the upstream
+func (c *capabilities) validate(resourceType string, query url.Values, tileMatrix string) Exception {
+	layer, ok := c.layers[query["layer"][0]]
+	if !ok {
+		return InvalidParameterValue("layer")
+	}
+
+	if len(query["style"]) > 0 && len(query["style"][0]) > 0 && len(layer.Styles) > 0 {
+		found := false
+		for _, s := range layer.Styles {
+			found = found || s.Identifier == query["style"][0]
+		}
+		if !found {
+			return InvalidParameterValue("style")
+		}
+	}
+
+	switch resourceType {
+	case resourceTypeTile:
+		if len(layer.Formats) > 0 && !contains(layer.Formats, query["format"][0]) {
+			return InvalidParameterValue("format")
+		}
+	case resourceTypeFeatureInfo:
+		if len(layer.InfoFormats) > 0 && !contains(layer.InfoFormats, query["infoformat"][0]) {
+			return InvalidParameterValue("infoformat")
+		}
+	}
+
+	link, ok := layer.tileMatrixSetLink(query["tilematrixset"][0])
+	if !ok {
+		return InvalidParameterValue("tilematrixset")
+	}
+	tileMatrixSet, ok := c.tileMatrixSets[link.TileMatrixSet]
+	if !ok {
+		return InvalidParameterValue("tilematrixset")
+	}
+	matrix, ok := tileMatrixSet.tileMatrix(tileMatrix)
+	if !ok {
+		return InvalidParameterValue("tilematrix")
+	}
+
+	minCol, maxCol, minRow, maxRow := 0, matrix.MatrixWidth-1, 0, matrix.MatrixHeight-1
+	if limits, ok := link.limits(tileMatrix); ok {
+		minCol, maxCol, minRow, maxRow = limits.MinTileCol, limits.MaxTileCol, limits.MinTileRow, limits.MaxTileRow
+	}
+	if err := checkRange("tilecol", query["tilecol"][0], minCol, maxCol, TileOutOfRange); err != nil {
+		return err
+	}
+	if err := checkRange("tilerow", query["tilerow"][0], minRow, maxRow, TileOutOfRange); err != nil {
+		return err
+	}
+
+	if resourceType == resourceTypeFeatureInfo {
+		if err := checkRange("i", query["i"][0], 0, matrix.TileWidth-1, PointIJOutOfRange); err != nil {
+			return err
+		}
+		if err := checkRange("j", query["j"][0], 0, matrix.TileHeight-1, PointIJOutOfRange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRange checks if the value of the parameter is an integer between min and max
+func checkRange(parameter string, value string, min int, max int, outOfRange func(string) Exception) Exception {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return InvalidParameterValue(parameter)
+	}
+	if v < min || v > max {
+		return outOfRange(parameter)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package operations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProcessGetTileRequestValidation(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"layer=unknown&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png":               "InvalidParameterValue for parameter: layer",
+		"layer=osm&style=grijs&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png":       "InvalidParameterValue for parameter: style",
+		"layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/jpeg":                  "InvalidParameterValue for parameter: format",
+		"layer=osm&tilematrixset=EPSG:28992&tilematrix=01&tilecol=1&tilerow=0&format=image/png":                        "InvalidParameterValue for parameter: tilematrixset",
+		"layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=02&tilecol=1&tilerow=0&format=image/png":                   "InvalidParameterValue for parameter: tilematrix",
+		"layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=2&tilerow=0&format=image/png":                   "TileOutOfRange for parameter: tilecol",
+		"layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=-1&format=image/png":                  "TileOutOfRange for parameter: tilerow",
+		"layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=a&tilerow=0&format=image/png":                   "InvalidParameterValue for parameter: tilecol",
+		"layer=plain&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=0&tilerow=0&format=image/png":                 "TileOutOfRange for parameter: tilecol",
+		"layer=plain&tilematrixset=GLOBAL_MERCATOR&tilematrix=GLOBAL_MERCATOR:01&tilecol=1&tilerow=1&format=image/png": "TileOutOfRange for parameter: tilerow",
+	}
+
+	for query, message := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+			RawQuery: "service=WMTS&request=GetTile&version=1.0.0&" + query}, Header: http.Header{}}
+		err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest)
+		if err == nil || err.Error() != message || err.Status() != http.StatusBadRequest {
+			t.Errorf("Expected %s for %s but was not, got: %v", message, query, err)
+		}
+	}
+}
+
+func TestProcessGetTileRequestDefaultStyleFromCapabilities(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate", TileTemplate: "/{Layer}/{Style}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}{FileExtension}"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+		RawQuery: "service=WMTS&request=GetTile&version=1.0.0&layer=plain&style=&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&format=image/png"}, Header: http.Header{}}
+	if err := ProcessGetTileRequest(config, httptest.NewRecorder(), mockRequest); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := "local/plain/standaard/GLOBAL_MERCATOR/01/1/0.png"
+	if mockRequest.URL.String() != expected {
+		t.Errorf("Expected %s but was not, got: %s", expected, mockRequest.URL.String())
+	}
+}
+
+func TestProcessGetFeatureInfoRequestValidation(t *testing.T) {
+	config := &Config{Template: "testCapabilitiesTemplate"}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Got an error: %s", err)
+	}
+
+	expected := map[string]string{
+		"infoformat=text/html&i=10&j=20":        "InvalidParameterValue for parameter: infoformat",
+		"infoformat=application/json&i=256&j=1": "PointIJOutOfRange for parameter: i",
+	}
+
+	for query, message := range expected {
+		mockRequest := &http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "local",
+			RawQuery: "service=WMTS&request=GetFeatureInfo&version=1.0.0&layer=osm&tilematrixset=GLOBAL_MERCATOR&tilematrix=01&tilecol=1&tilerow=0&" + query}, Header: http.Header{}}
+		err := ProcessGetFeatureInfoRequest(config, httptest.NewRecorder(), mockRequest)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected %s for %s but was not, got: %v", message, query, err)
+		}
+	}
+}
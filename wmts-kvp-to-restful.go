@@ -2,75 +2,272 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/PDOK/wmts-kvp-to-restful/operations"
 	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	shutdownTimeout = 15 * time.Second
 )
 
-// https://ndersson.me/post/capturing_status_code_in_net_http/
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
+// dimensionFlags collects the repeatable -dimension flag
+type dimensionFlags []operations.Dimension
+
+func (d *dimensionFlags) String() string {
+	return fmt.Sprint(*d)
 }
 
-// NewLoggingResponseWriter wrapper for the http.ResponseWriter
-func newLoggingResponseWriter(w http.ResponseWriter) *loggingResponseWriter {
-	return &loggingResponseWriter{w, http.StatusOK}
+func (d *dimensionFlags) Set(value string) error {
+	dimension, err := operations.ParseDimension(value)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, dimension)
+	return nil
 }
 
-func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
+// formatFlags collects the repeatable -format flag
+type formatFlags map[string]string
+
+func (f formatFlags) String() string {
+	return fmt.Sprint(map[string]string(f))
 }
 
-// https://stackoverflow.com/questions/10510691/how-to-check-whether-a-file-or-directory-exists/10510718
-func exists(path string) bool {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true
+func (f formatFlags) Set(value string) error {
+	format, extension, err := operations.ParseFormatExtension(value)
+	if err != nil {
+		return err
 	}
-	if os.IsNotExist(err) {
-		log.Fatal(err)
-		return false
+	f[format] = extension
+	return nil
+}
+
+// upstreamFlags collects the repeatable -upstream flag
+type upstreamFlags []operations.Upstream
+
+func (u *upstreamFlags) String() string {
+	return fmt.Sprint(*u)
+}
+
+func (u *upstreamFlags) Set(value string) error {
+	upstream, err := operations.ParseUpstream(value)
+	if err != nil {
+		return err
+	}
+	*u = append(*u, upstream)
+	return nil
+}
+
+// rateLimitFlags collects the repeatable -rate-limit flag
+type rateLimitFlags []operations.RateLimit
+
+func (l *rateLimitFlags) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *rateLimitFlags) Set(value string) error {
+	limit, err := operations.ParseRateLimit(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, limit)
+	return nil
+}
+
+// listFlags holds a comma separated list flag, the flag replaces the whole list
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlags) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// newFlagSet binds the command line flags to the config, the defaults of the flags are the current values
+func newFlagSet(config *operations.Config, configFile *string, printConfig *bool) *flag.FlagSet {
+	if config.FormatExtensions == nil {
+		config.FormatExtensions = map[string]string{}
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(configFile, "config", *configFile, "Optional YAML config file, the flags and WMTS_* environment variables override its settings")
+	fs.BoolVar(printConfig, "print-config", *printConfig, "Print the effective config, with the secrets redacted, and exit")
+	fs.StringVar(&config.Host, "host", config.Host, "Hostname to proxy with protocol, http/https and port")
+	fs.StringVar(&config.Mode, "mode", config.Mode, "Mode, kvp: rewrite KVP requests to RESTful requests, restful: rewrite RESTful requests to KVP requests")
+	fs.StringVar(&config.Template, "t", config.Template, "Optional GetCapabilities template file, if not set request will be proxied.")
+	fs.BoolVar(&config.UpstreamCapabilities, "upstream-capabilities", config.UpstreamCapabilities, "Fetch the GetCapabilities document from the upstream and rewrite it to the public host and path, instead of using a template")
+	fs.DurationVar(&config.CapabilitiesTTL, "capabilities-ttl", config.CapabilitiesTTL, "Time the GetCapabilities document fetched from the upstream is cached")
+	fs.BoolVar(&config.Logging, "l", config.Logging, "Enable request logging, default: false")
+	fs.IntVar(&config.LogBuffer, "log-buffer", config.LogBuffer, "Number of access log lines that can wait to be written, when full lines are dropped")
+	fs.IntVar(&config.ShutdownDelay, "d", config.ShutdownDelay, "Delay (in seconds) before initiating graceful shutdown (e.g. useful in k8s to allow ingress controller to update their endpoints list, default: 0")
+	fs.StringVar(&config.TileTemplate, "tile-template", config.TileTemplate, "Optional RESTful path template for GetTile requests, default: /{Layer}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}{FileExtension}")
+	fs.StringVar(&config.FeatureInfoTemplate, "featureinfo-template", config.FeatureInfoTemplate, "Optional RESTful path template for GetFeatureInfo requests, default: /{Layer}/{TileMatrixSet}/{TileMatrix}/{TileCol}/{TileRow}/{I}/{J}{FileExtension}")
+	fs.StringVar(&config.DefaultStyle, "default-style", config.DefaultStyle, "Style used for the {Style} placeholder when the STYLE parameter is missing or empty")
+	fs.Var((*dimensionFlags)(&config.Dimensions), "dimension", "Dimension used in the path templates as <layer>/<identifier>=<default>, layer (glob) and default are optional. Can be repeated")
+	fs.Var(formatFlags(config.FormatExtensions), "format", "Mapping of a GetTile format to a file extension as <format>=<extension>, extends the default mapping. Can be repeated")
+	fs.Var((*upstreamFlags)(&config.Upstreams), "upstream", "Upstream for a layer as <layer>=<host>, layer is a glob pattern. Layers without a matching upstream use -host. Can be repeated")
+	fs.Var(&config.TileCacheSize, "tile-cache-size", "Size of the in memory cache for GetTile responses, like 256MB, default: 0 (disabled)")
+	fs.DurationVar(&config.TileCacheTTL, "tile-cache-ttl", config.TileCacheTTL, "Time a GetTile response without Cache-Control or Expires header is cached")
+	fs.BoolVar(&config.Coalesce, "coalesce", config.Coalesce, "Collapse identical GetTile requests in flight into a single upstream request, default: true")
+	fs.DurationVar(&config.ReloadInterval, "reload-interval", config.ReloadInterval, "Interval the config file and capabilities template are checked for changes, 0 disables the check")
+	fs.StringVar(&config.ListenAddress, "listen", config.ListenAddress, "Address the server listens on")
+	fs.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "TLS certificate file, serves HTTPS together with -tls-key")
+	fs.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "TLS key file, serves HTTPS together with -tls-cert")
+	fs.BoolVar(&config.HTTP2, "http2", config.HTTP2, "Serve HTTP/2 over TLS, default: true")
+	fs.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", config.ReadHeaderTimeout, "Maximum time to read the request headers")
+	fs.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "Maximum time to read the whole request")
+	fs.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "Maximum time to write the response, including the upstream request")
+	fs.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "Maximum time to keep an idle connection open")
+	fs.DurationVar(&config.ConnectTimeout, "upstream-connect-timeout", config.ConnectTimeout, "Maximum time to connect to the upstream")
+	fs.DurationVar(&config.ResponseTimeout, "upstream-response-timeout", config.ResponseTimeout, "Maximum time to wait for the response headers of the upstream")
+	fs.IntVar(&config.Retries, "upstream-retries", config.Retries, "Number of retries of a GetTile request when the upstream is unavailable")
+	fs.IntVar(&config.BreakerFailures, "circuit-breaker-failures", config.BreakerFailures, "Consecutive failures of an upstream that open its circuit breaker, 0 disables the circuit breaker")
+	fs.DurationVar(&config.BreakerCooldown, "circuit-breaker-cooldown", config.BreakerCooldown, "Time an open circuit breaker fails fast before a trial request")
+	fs.Var((*rateLimitFlags)(&config.RateLimits), "rate-limit", "Rate limit per client for an operation as <operation>=<rate>[:<burst>], the rate in requests per second. Operation * applies to all other requests. Can be repeated")
+	fs.IntVar(&config.TrustedProxies, "trusted-proxies", config.TrustedProxies, "Number of proxies in front of the service that add the client address to X-Forwarded-For, used to identify clients for the rate limit and the access log")
+	fs.StringVar(&config.AuthKeyFile, "auth-key-file", config.AuthKeyFile, "Optional file with the accepted API keys, one per line. Requests without a valid key or token are refused")
+	fs.StringVar(&config.AuthTokenSecret, "auth-token-secret", config.AuthTokenSecret, "Optional secret of the accepted HMAC-SHA256 signed tokens. Requests without a valid key or token are refused")
+	fs.StringVar(&config.AuthParameter, "auth-parameter", config.AuthParameter, "Query parameter with the API key or token")
+	fs.StringVar(&config.AuthHeader, "auth-header", config.AuthHeader, "Header with the API key or token, a Bearer token in the Authorization header is accepted as well")
+	fs.Var((*listFlags)(&config.CORSAllowedOrigins), "cors-allowed-origins", "Comma separated origins (glob) allowed to do cross-origin requests, * allows every origin and an empty list disables CORS")
+	fs.Var((*listFlags)(&config.CORSAllowedMethods), "cors-allowed-methods", "Comma separated methods allowed for cross-origin requests")
+	fs.Var((*listFlags)(&config.CORSAllowedHeaders), "cors-allowed-headers", "Comma separated request headers allowed for cross-origin requests, * allows every header")
+	fs.Var((*listFlags)(&config.CORSExposedHeaders), "cors-exposed-headers", "Comma separated response headers exposed to cross-origin requests")
+	fs.DurationVar(&config.CORSMaxAge, "cors-max-age", config.CORSMaxAge, "Time a browser may cache the answer to a preflight request, 0 leaves it to the browser")
+	return fs
+}
+
+// loadConfig reads the config from the config file, the environment and the flags, in that order.
+// It also returns the config file and whether the config should be printed.
+func loadConfig() (*operations.Config, string, bool, error) {
+	var configFile string
+	var printConfig bool
+	config := operations.NewConfig()
+	// the flags are parsed twice, first to find the config file and then to override its settings
+	newFlagSet(config, &configFile, &printConfig).Parse(os.Args[1:])
+
+	config = operations.NewConfig()
+	if len(configFile) > 0 {
+		if err := operations.LoadConfigFile(configFile, config); err != nil {
+			return nil, "", false, err
+		}
+	}
+	if err := config.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, "", false, err
+	}
+	newFlagSet(config, &configFile, &printConfig).Parse(os.Args[1:])
+
+	if len(config.Host) == 0 {
+		return nil, "", false, fmt.Errorf("no target host is configured")
+	}
+	return config, configFile, printConfig, nil
+}
+
+// reloadConfig loads and initialises the config
+func reloadConfig() (*operations.Config, error) {
+	config, _, _, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Init(); err != nil {
+		return nil, err
 	}
-	log.Println(err)
-	return true
+	return config, nil
 }
 
 func main() {
-	host := flag.String("host", "http://localhost", "Hostname to proxy with protocol, http/https and port")
-	template := flag.String("t", "", "Optional GetCapabilities template file, if not set request will be proxied.")
-	logrequest := flag.Bool("l", false, "Enable request logging, default: false")
-	shutdownDelay := flag.Int("d", 0, "Delay (in seconds) before initiating graceful shutdown (e.g. useful in k8s to allow ingress controller to update their endpoints list, default: 0")
-	flag.Parse()
-
-	if len(*host) == 0 {
-		log.Fatal("No target host is configured")
+	config, configFile, printConfig, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		fmt.Print(config)
+		if err := config.Validate(); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
-	if len(*template) > 0 && !exists(*template) {
-		return
+	if err := config.Init(); err != nil {
+		log.Fatal(err)
 	}
 
-	config := &operations.Config{Host: *host, Template: *template, Logging: *logrequest}
+	// the config is reloaded on SIGHUP and when the config file or capabilities template changes
+	reloader := operations.NewReloader(config, reloadConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var files []string
+	if len(configFile) > 0 {
+		files = append(files, configFile)
+	}
+	go reloader.Watch(ctx, config.ReloadInterval, files...)
 
-	origin, _ := url.Parse(*host)
+	server := &http.Server{
+		Addr:              config.ListenAddress,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	if !config.HTTP2 {
+		// a non-nil map disables the automatic HTTP/2 support
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	var certificates *operations.CertificateReloader
+	if len(config.TLSCert) > 0 {
+		certificates, err = operations.NewCertificateReloader(config.TLSCert, config.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certificates.GetCertificate}
+		go certificates.Watch(ctx, config.ReloadInterval)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloader.Reload()
+			if certificates != nil {
+				certificates.Reload()
+			}
+		}
+	}()
 
 	director := func(req *http.Request) {
+		var origin *url.URL
+		if info := operations.GetRequestInfo(req); info != nil {
+			origin = info.Upstream
+		}
+		if origin == nil {
+			origin = reloader.Config().Upstream("")
+		}
+
 		req.URL.Host = origin.Host
 		req.URL.Scheme = origin.Scheme
 		req.Host = origin.Host
@@ -78,70 +275,99 @@ func main() {
 		req.Header.Add("X-Origin-Host", origin.Host)
 	}
 
+	// every response gets the same CORS headers, preflight requests are answered locally
 	router := chi.NewRouter()
-	proxy := &httputil.ReverseProxy{Director: director}
+	router.Use(operations.NewCORS(reloader.Config).Handler)
+	proxy := &httputil.ReverseProxy{
+		Director:     director,
+		Transport:    operations.InstrumentTransport(operations.NewUpstreamTransport(reloader.Config)),
+		ErrorHandler: operations.ProxyErrorHandler,
+	}
+
+	var upstream http.Handler = proxy
+	if config.Coalesce {
+		upstream = operations.NewCoalescer(upstream, config.WriteTimeout)
+	}
+	if config.TileCacheSize > 0 {
+		tileCache := operations.NewTileCache(config, upstream)
+		upstream = tileCache
+
+		router.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			json.NewEncoder(w).Encode(tileCache.Stats())
+		})
+		promauto.NewCounterFunc(prometheus.CounterOpts{Name: "wmts_tile_cache_hits_total", Help: "Number of GetTile requests answered from the tile cache."},
+			func() float64 { return float64(tileCache.Stats().Hits) })
+		promauto.NewCounterFunc(prometheus.CounterOpts{Name: "wmts_tile_cache_misses_total", Help: "Number of GetTile requests not found in the tile cache."},
+			func() float64 { return float64(tileCache.Stats().Misses) })
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: "wmts_tile_cache_bytes", Help: "Size of the tiles in the tile cache."},
+			func() float64 { return float64(tileCache.Stats().Bytes) })
+	}
 
-	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	// liveness only tells the application is running, readiness checks the upstreams and the capabilities
+	live := func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.Write([]byte(`{"health": "OK"}`))
 		return
-	})
-
-	log.Println("wmts-kvp-to-restful started")
+	}
+	router.HandleFunc("/health", live)
+	router.HandleFunc("/health/live", live)
+	router.Handle("/health/ready", operations.NewReadiness(reloader.Config))
 
-	router.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/metrics", promhttp.Handler())
 
-		// Simple logging ...
-		// TODO put logging on a chan for async output
-		var logrequesturi string
-		var start time.Time
-		var elapsed time.Duration
+	log.Println("wmts-kvp-to-restful started")
 
-		if config.Logging {
-			start = time.Now()
-			logrequesturi = r.URL.RequestURI()
+	// clients are rate limited after the authentication, so an authenticated client is limited by its name
+	rateLimiter := operations.NewRateLimiter(reloader.Config)
+	authenticator := operations.NewAuthenticator(reloader.Config)
+	var handler http.Handler = operations.InstrumentRequests(authenticator.Handler(rateLimiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := reloader.Config()
+		var mustproxy bool
+		if config.Mode == operations.ModeRESTful {
+			mustproxy = operations.ProcessRESTfulRequest(config, w, r)
+		} else {
+			mustproxy = operations.ProcessRequest(config, w, r)
 		}
-
-		lrw := newLoggingResponseWriter(w)
-		mustproxy := operations.ProcessRequest(config, lrw, r)
 		if mustproxy {
-			proxy.ServeHTTP(lrw, r)
-
+			upstream.ServeHTTP(w, r)
 		}
+	}))))
 
-		if config.Logging {
-			elapsed = time.Since(start)
-			if mustproxy {
-				log.Printf("%d %s %s %s", lrw.statusCode, elapsed.Round(time.Millisecond), logrequesturi, r.URL.RequestURI())
-			} else {
-				log.Printf("%d %s %s", lrw.statusCode, elapsed.Round(time.Millisecond), r.URL.RequestURI())
-			}
-		}
-		return
-	})
+	if config.Logging {
+		accessLog := operations.NewAccessLogger(reloader.Config, os.Stdout, config.LogBuffer)
+		defer accessLog.Close()
+		handler = accessLog.Handler(handler)
 
-	err := startServer("wmts-kvp-to-restful", ":9001", *shutdownDelay, router)
+		promauto.NewCounterFunc(prometheus.CounterOpts{Name: "wmts_access_log_dropped_total", Help: "Number of access log lines dropped because the output couldn't keep up."},
+			func() float64 { return float64(accessLog.Dropped()) })
+	}
+	router.Handle("/*", handler)
+
+	server.Handler = router
+	err = startServer("wmts-kvp-to-restful", server, config.ShutdownDelay)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// startServer creates and starts an HTTP server, also takes care of graceful shutdown
-func startServer(name string, address string, shutdownDelay int, router http.Handler) error {
-	// Create HTTP server
-	server := http.Server{
-		Addr:    address,
-		Handler: router,
-	}
-
+// startServer starts the HTTP server, with TLS when it has a TLS config, also takes care of graceful shutdown
+func startServer(name string, server *http.Server, shutdownDelay int) error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer stop()
 
 	go func() {
-		log.Printf("%s listening on %s", name, address)
+		log.Printf("%s listening on %s", name, server.Addr)
 		// ListenAndServe always returns a non-nil error. After Shutdown or
 		// Close, the returned error is ErrServerClosed
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			// the certificate comes from the TLS config
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("failed to shutdown %s: %v", name, err)
 		}
 	}()